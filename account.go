@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"maps"
+	"net/http"
 	"net/url"
 	"os"
 
@@ -36,7 +37,7 @@ func getHeaders() map[string]string {
 	return headers
 }
 
-func signUp(email, password, nickname string) ([]byte, error) {
+func signUp(client *http.Client, email, password, nickname string) ([]byte, error) {
     body := map[string]any{
         "idToken": nil,
         "email":    email,
@@ -73,15 +74,15 @@ func signUp(email, password, nickname string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return CallAPI("POST", "https://sdk.weverse.io/api/v3/signup/by-credentials", encodedBody, getHeaders())
+	return CallAPI(client, "POST", "https://sdk.weverse.io/api/v3/signup/by-credentials", encodedBody, getHeaders())
 }
 
-func check_verification(email string) ([]byte, error) {
+func check_verification(client *http.Client, email string) ([]byte, error) {
 	queryUrl := "https://sdk.weverse.io/api/v1/signup/email/status?email=" + url.QueryEscape(email)
-	return CallAPI("GET", queryUrl, nil, getHeaders())
+	return CallAPI(client, "GET", queryUrl, nil, getHeaders())
 }
 
-func getToken(email, password string) ([]byte, error) {
+func getToken(client *http.Client, email, password string) ([]byte, error) {
 	body := map[string]any{
 		"email":    email,
 		"password": password,
@@ -90,5 +91,5 @@ func getToken(email, password string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return CallAPI("POST", "https://sdk.weverse.io/api/v2/auth/token/by-credentials", encodedBody, getHeaders())
+	return CallAPI(client, "POST", "https://sdk.weverse.io/api/v2/auth/token/by-credentials", encodedBody, getHeaders())
 }
\ No newline at end of file
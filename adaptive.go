@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	adaptiveInterval   = 5 * time.Second
+	adaptiveStartLimit = 2
+	adaptiveMinGain    = 1.05 // throughput has to improve by 5% before growing again
+)
+
+// adaptiveController tunes the number of concurrent calls and per-file chunk
+// workers. It starts low, grows while aggregate throughput keeps improving and
+// halves both on throttling responses or connection resets.
+type adaptiveController struct {
+	mu        sync.Mutex
+	calls     int
+	maxCalls  int
+	chunks    int
+	maxChunks int
+	active    int
+	wake      chan struct{}
+
+	bytes          atomic.Int64
+	errors         atomic.Int64
+	lastThroughput float64
+}
+
+func newAdaptiveController(maxCalls, maxChunks int) *adaptiveController {
+	return &adaptiveController{
+		calls:     min(adaptiveStartLimit, maxCalls),
+		maxCalls:  maxCalls,
+		chunks:    min(adaptiveStartLimit, maxChunks),
+		maxChunks: maxChunks,
+		wake:      make(chan struct{}),
+	}
+}
+
+// Acquire blocks until a call may start downloading.
+func (a *adaptiveController) Acquire(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	for {
+		a.mu.Lock()
+		if a.active < a.calls {
+			a.active++
+			a.mu.Unlock()
+			return nil
+		}
+		wake := a.wake
+		a.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (a *adaptiveController) Release() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.active--
+	a.notify()
+	a.mu.Unlock()
+}
+
+// notify wakes up everything waiting in Acquire. a.mu must be held.
+func (a *adaptiveController) notify() {
+	close(a.wake)
+	a.wake = make(chan struct{})
+}
+
+// Chunks returns how many range requests a file starting now should use.
+func (a *adaptiveController) Chunks() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.chunks
+}
+
+// Limits returns the current number of concurrent calls and chunk workers.
+func (a *adaptiveController) Limits() (calls, chunks int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls, a.chunks
+}
+
+// ReportError records a failed request if it indicates the server or the
+// network is overloaded.
+func (a *adaptiveController) ReportError(err error) {
+	if a == nil || err == nil {
+		return
+	}
+	if isOverloadError(err) {
+		a.errors.Add(1)
+	}
+}
+
+func isOverloadError(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Code == http.StatusTooManyRequests || se.Code >= 500
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// reader counts bytes read from r towards the measured throughput.
+func (a *adaptiveController) reader(r io.Reader) io.Reader {
+	if a == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &a.bytes}
+}
+
+// Run adjusts the limits every adaptiveInterval until ctx is done.
+func (a *adaptiveController) Run(ctx context.Context) {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.adjust(float64(a.bytes.Swap(0))/adaptiveInterval.Seconds(), a.errors.Swap(0))
+		}
+	}
+}
+
+func (a *adaptiveController) adjust(throughput float64, errs int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case errs > 0:
+		a.calls = max(1, a.calls/2)
+		a.chunks = max(1, a.chunks/2)
+	case throughput > a.lastThroughput*adaptiveMinGain:
+		// grow whichever limit is further from its maximum
+		if a.chunks*a.maxCalls <= a.calls*a.maxChunks && a.chunks < a.maxChunks {
+			a.chunks++
+		} else if a.calls < a.maxCalls {
+			a.calls++
+			a.notify()
+		} else if a.chunks < a.maxChunks {
+			a.chunks++
+		}
+	}
+	a.lastThroughput = throughput
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
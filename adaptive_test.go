@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveAdjust(t *testing.T) {
+	a := newAdaptiveController(3, 4)
+	steps := []struct {
+		name       string
+		throughput float64
+		errs       int64
+		calls      int
+		chunks     int
+	}{
+		{"start", 0, 0, 2, 2},
+		{"faster", 100, 0, 2, 3},
+		{"faster again", 200, 0, 3, 3},
+		{"not enough faster", 205, 0, 3, 3},
+		{"faster", 300, 0, 3, 4},
+		{"at the maximum", 400, 0, 3, 4},
+		{"errors halve both", 400, 2, 1, 2},
+		{"errors keep at least one", 400, 1, 1, 1},
+	}
+	for i, step := range steps {
+		if i > 0 {
+			a.adjust(step.throughput, step.errs)
+		}
+		if calls, chunks := a.Limits(); calls != step.calls || chunks != step.chunks {
+			t.Fatalf("%s: limits %d calls, %d chunks, want %d, %d", step.name, calls, chunks, step.calls, step.chunks)
+		}
+	}
+}
+
+func TestAdaptiveAcquire(t *testing.T) {
+	a := newAdaptiveController(2, 2)
+	ctx := context.Background()
+	for range 2 {
+		if err := a.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := a.Acquire(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("third call started with a limit of 2: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.Acquire(ctx) }()
+	a.Release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting call did not start after a release")
+	}
+}
+
+func TestIsOverloadError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&statusError{Code: 429}, true},
+		{&statusError{Code: 503}, true},
+		{fmt.Errorf("chunk: %w", &statusError{Code: 500}), true},
+		{&statusError{Code: 404}, false},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("disk full"), false},
+	}
+	for _, tt := range tests {
+		if got := isOverloadError(tt.err); got != tt.want {
+			t.Errorf("isOverloadError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -5,15 +5,14 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
 // CallAPI sends an HTTP request to the specified URL with the given method and body.
 // It returns the response body as a byte slice and any error encountered.
-func CallAPI(method, url string, body []byte, headers map[string]string) ([]byte, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-
+func CallAPI(client *http.Client, method, url string, body []byte, headers map[string]string) ([]byte, error) {
 	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
@@ -23,11 +22,17 @@ func CallAPI(method, url string, body []byte, headers map[string]string) ([]byte
 		req.Header.Set(k, v)
 	}
 
+	start := time.Now()
 	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	stats.observeAPI(req.URL, elapsed)
 	if err != nil {
+		slog.Debug("API request failed", "method", method, "endpoint", apiEndpoint(req.URL), "duration", elapsed, "err", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	stats.observeResponse("api", resp.StatusCode)
+	slog.Debug("API request", "method", method, "endpoint", apiEndpoint(req.URL), "status", resp.StatusCode, "duration", elapsed)
 
 	var reader io.Reader = resp.Body
 	if resp.Header.Get("Content-Encoding") == "gzip" {
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// newFileBar adds a bar showing the transfer of a single file. Options such as
+// mpb.BarPriority are applied after the default ones.
+func newFileBar(p *mpb.Progress, name string, total int64, options ...mpb.BarOption) *mpb.Bar {
+	defaults := []mpb.BarOption{
+		mpb.PrependDecorators(
+			decor.Name(name, decor.WC{W: 5, C: decor.DindentRight}),
+			decor.Current(decor.SizeB1024(0), "% .1f", decor.WC{W: 11}),
+			decor.TotalKibiByte(" / % .1f", decor.WC{W: 14, C: decor.DindentRight}),
+			decor.AverageSpeed(decor.SizeB1024(0), "% .1f", decor.WC{W: 13}),
+			decor.Elapsed(decor.ET_STYLE_MMSS, decor.WC{W: 10}),
+			decor.OnComplete(
+				decor.Name(" ETA: "),
+				color.GreenString(" Done"),
+			),
+			decor.OnComplete(
+				decor.AverageETA(decor.ET_STYLE_MMSS, decor.WC{W: 9, C: decor.DindentRight}),
+				"",
+			),
+		),
+		mpb.BarFillerOnComplete(""),
+		mpb.AppendDecorators(
+			decor.OnComplete(
+				decor.NewPercentage("%.2f", decor.WC{W: 7}),
+				"",
+			),
+		),
+	}
+	return p.New(total,
+		mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
+		append(defaults, options...)...,
+	)
+}
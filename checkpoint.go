@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// checkpointExt is appended to the path of a download that was interrupted.
+// The sidecar records how far every chunk got, so the download can resume.
+const checkpointExt = ".part.json"
+
+type checkpoint struct {
+	Size   int64             `json:"size"`
+	Chunks []checkpointChunk `json:"chunks"`
+}
+
+type checkpointChunk struct {
+	Start  int64 `json:"start"`
+	End    int64 `json:"end"`
+	Offset int64 `json:"offset"`
+}
+
+// hasCheckpoint reports whether the file at path is an interrupted download.
+func hasCheckpoint(path string) bool {
+	_, err := os.Stat(path + checkpointExt)
+	return err == nil
+}
+
+// saveCheckpoint records the progress of the chunks of an interrupted download.
+func saveCheckpoint(path string, size int64, chunks []*chunk) error {
+	cp := checkpoint{Size: size}
+	for _, c := range chunks {
+		cp.Chunks = append(cp.Chunks, checkpointChunk{Start: c.start, End: c.end, Offset: c.offset.Load()})
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + checkpointExt + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+checkpointExt)
+}
+
+// loadCheckpoint returns the chunks of an interrupted download of size bytes to
+// path, or nil if there is none that can be resumed.
+func loadCheckpoint(path string, size int64) []*chunk {
+	data, err := os.ReadFile(path + checkpointExt)
+	if err != nil {
+		return nil
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil || cp.Size != size || len(cp.Chunks) == 0 {
+		return nil
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != size {
+		return nil
+	}
+	chunks := make([]*chunk, len(cp.Chunks))
+	next := int64(0)
+	for i, c := range cp.Chunks {
+		// the chunks have to cover the file exactly, in order
+		if c.Start != next || c.End < c.Start || c.Offset < c.Start || c.Offset > c.End+1 {
+			return nil
+		}
+		chunks[i] = newChunk(c.Start, c.End)
+		chunks[i].offset.Store(c.Offset)
+		next = c.End + 1
+	}
+	if next != size {
+		return nil
+	}
+	return chunks
+}
+
+func removeCheckpoint(path string) {
+	os.Remove(path + checkpointExt)
+}
@@ -1,28 +1,193 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/hex"
 	"fmt"
+	gohash "hash"
 	"io"
 	"os"
+	"slices"
 	"strings"
+	"time"
 )
 
-func checksum(filePath string) (string, error) {
+const hashCursorInterval = 100 * time.Millisecond
+
+// hashAlgorithm describes a hash that can appear in a manifest.
+type hashAlgorithm struct {
+	new    func() gohash.Hash
+	encode func([]byte) string
+}
+
+// hashAlgorithms lists the supported algorithms by their manifest name.
+// SHA-1 keeps the unpadded base32 encoding of the original hash/sum.json.
+var hashAlgorithms = map[string]hashAlgorithm{
+	"sha1": {
+		new: sha1.New,
+		encode: func(sum []byte) string {
+			return strings.TrimRight(base32.StdEncoding.EncodeToString(sum), "=")
+		},
+	},
+	"sha256": {
+		new:    sha256.New,
+		encode: hex.EncodeToString,
+	},
+}
+
+// hashSet computes several algorithms over the same stream of bytes.
+type hashSet struct {
+	hashes map[string]gohash.Hash
+}
+
+func newHashSet(algorithms ...string) (*hashSet, error) {
+	set := &hashSet{hashes: make(map[string]gohash.Hash, len(algorithms))}
+	for _, name := range algorithms {
+		alg, ok := hashAlgorithms[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash algorithm %q", name)
+		}
+		set.hashes[name] = alg.new()
+	}
+	return set, nil
+}
+
+func (s *hashSet) Write(p []byte) (int, error) {
+	for _, h := range s.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (s *hashSet) Reset() {
+	for _, h := range s.hashes {
+		h.Reset()
+	}
+}
+
+// Sums returns the encoded digest of every algorithm in the set.
+func (s *hashSet) Sums() map[string]string {
+	sums := make(map[string]string, len(s.hashes))
+	for name, h := range s.hashes {
+		sums[name] = hashAlgorithms[name].encode(h.Sum(nil))
+	}
+	return sums
+}
+
+// checksum hashes a file with the given algorithms in a single pass.
+func checksum(filePath string, algorithms ...string) (map[string]string, error) {
+	set, err := newHashSet(algorithms...)
+	if err != nil {
+		return nil, err
+	}
 	file, err := os.Open(filePath)
 	if err != nil {
-		return "", fmt.Errorf("file not found: %s", filePath)
+		return nil, fmt.Errorf("file not found: %s", filePath)
 	}
 	defer file.Close()
 
-	hasher := sha1.New()
 	buf := make([]byte, 64*1024) // 64 KiB buffer
-	_, err = io.CopyBuffer(hasher, file, buf)
+	_, err = io.CopyBuffer(set, file, buf)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash: %v", err)
+		return nil, fmt.Errorf("failed to hash: %v", err)
 	}
 
-	encoded := base32.StdEncoding.EncodeToString(hasher.Sum(nil))
-	return strings.TrimRight(encoded, "="), nil
-}
\ No newline at end of file
+	return set.Sums(), nil
+}
+
+// blockHasher records the hex SHA-256 of every blockSize bytes written to it.
+type blockHasher struct {
+	blockSize int64
+	current   gohash.Hash
+	filled    int64
+	blocks    []string
+}
+
+func newBlockHasher(blockSize int64) *blockHasher {
+	return &blockHasher{blockSize: blockSize, current: sha256.New()}
+}
+
+func (b *blockHasher) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := min(int64(len(p)), b.blockSize-b.filled)
+		b.current.Write(p[:n])
+		b.filled += n
+		p = p[n:]
+		if b.filled == b.blockSize {
+			b.blocks = append(b.blocks, hex.EncodeToString(b.current.Sum(nil)))
+			b.current.Reset()
+			b.filled = 0
+		}
+	}
+	return total, nil
+}
+
+// Blocks returns the block hashes, including a final partial block.
+func (b *blockHasher) Blocks() []string {
+	if b.filled > 0 {
+		return append(slices.Clone(b.blocks), hex.EncodeToString(b.current.Sum(nil)))
+	}
+	return b.blocks
+}
+
+// hashCursor hashes a file while several chunk workers are still writing it.
+// It follows the contiguous prefix that is already on disk and reads it back
+// while it is fresh in the page cache, so no separate pass over the file is needed.
+type hashCursor struct {
+	h      *hashSet
+	file   io.ReaderAt
+	chunks []*chunk // in file order
+	length int64
+	hashed int64
+}
+
+// prefix returns how many bytes from the start of the file have been written.
+func (c *hashCursor) prefix() int64 {
+	for _, ch := range c.chunks {
+		if offset := ch.offset.Load(); offset <= ch.end {
+			return offset
+		}
+	}
+	return c.length
+}
+
+func (c *hashCursor) catchUp() error {
+	end := c.prefix()
+	if c.hashed >= end {
+		return nil
+	}
+	if _, err := io.Copy(c.h, io.NewSectionReader(c.file, c.hashed, end-c.hashed)); err != nil {
+		return err
+	}
+	c.hashed = end
+	return nil
+}
+
+// follow keeps hashing the written prefix until done is closed, then hashes
+// whatever is left. It fails if the whole file could not be hashed.
+func (c *hashCursor) follow(ctx context.Context, done <-chan struct{}) error {
+	ticker := time.NewTicker(hashCursorInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.catchUp(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			if err := c.catchUp(); err != nil {
+				return err
+			}
+			if c.hashed != c.length {
+				return fmt.Errorf("only %d of %d bytes were written", c.hashed, c.length)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
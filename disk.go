@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// diskPollInterval is how often a download waiting for disk space checks again
+// when no other download finished in the meantime.
+const diskPollInterval = 30 * time.Second
+
+// diskLedger hands out the space of the output directory to downloads. Files are
+// preallocated sparsely, so the free space of the file system does not include
+// what running downloads are still going to write; every download reserves its
+// size, and the part of it that is not on disk yet is subtracted. A download
+// that does not fit waits until space is freed instead of failing. A nil
+// *diskLedger reserves nothing.
+type diskLedger struct {
+	dir     string
+	minFree int64 // kept free at all times
+
+	mu       sync.Mutex
+	reserved map[string]int64 // size of the files being downloaded, by path
+	wake     chan struct{}    // closed when a reservation ends
+}
+
+func newDiskLedger(dir string, minFree int64) *diskLedger {
+	return &diskLedger{dir: dir, minFree: minFree, reserved: make(map[string]int64), wake: make(chan struct{})}
+}
+
+// reserve waits until a file of size bytes fits at path, keeping the minimum
+// free space, and reserves the space for it. release ends the reservation once
+// the file is complete or the download stopped.
+func (l *diskLedger) reserve(ctx context.Context, path string, size int64) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	var waiting time.Time
+	for {
+		l.mu.Lock()
+		need, available, err := l.check(path, size)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		if need <= available {
+			l.reserved[path] = size
+			l.mu.Unlock()
+			if !waiting.IsZero() {
+				slog.Info("Disk space available, resuming download", "file", path, "waited", time.Since(waiting).Round(time.Second))
+			}
+			var once sync.Once
+			return func() { once.Do(func() { l.release(path) }) }, nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		if waiting.IsZero() {
+			waiting = time.Now()
+			stats.diskWaiting.Add(1)
+			defer stats.diskWaiting.Add(-1)
+			slog.Warn("Not enough disk space, download waits until space is freed", "file", path,
+				"need", formatByteSize(need), "available", formatByteSize(max(available, 0)), "minFree", formatByteSize(l.minFree))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wake:
+		case <-time.After(diskPollInterval):
+		}
+	}
+}
+
+// check returns how much of a file of size bytes at path is not on disk yet,
+// and how much space is left for it. l.mu must be held.
+func (l *diskLedger) check(path string, size int64) (need, available int64, err error) {
+	free, err := getDiskFreeSpace(l.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var outstanding int64
+	for p, s := range l.reserved {
+		outstanding += unallocated(p, s)
+	}
+	return unallocated(path, size), free - outstanding - l.minFree, nil
+}
+
+func (l *diskLedger) release(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.reserved, path)
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// unallocated is how much of a file of size bytes at path still has to be written
+// to disk, e.g. all of it for a new file and the rest for a resumed download.
+func unallocated(path string, size int64) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return size
+	}
+	return max(size-allocatedSize(info), 0)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUnallocated(t *testing.T) {
+	dir := t.TempDir()
+	written := filepath.Join(dir, "written.mp4")
+	if err := os.WriteFile(written, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sparse := filepath.Join(dir, "sparse.mp4")
+	if err := os.WriteFile(sparse, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(sparse, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		path     string
+		size     int64
+		min, max int64
+	}{
+		{"missing", filepath.Join(dir, "missing.mp4"), 1 << 20, 1 << 20, 1 << 20},
+		{"written", written, 1 << 20, 0, 0},
+		{"resumed", written, 3 << 20, 2 << 20, 2 << 20},
+	}
+	if runtime.GOOS != "windows" {
+		// preallocated files are sparse until the download writes them
+		tests = append(tests, struct {
+			name     string
+			path     string
+			size     int64
+			min, max int64
+		}{"sparse", sparse, 1 << 20, 1<<20 - 64<<10, 1 << 20})
+	}
+	for _, tt := range tests {
+		if got := unallocated(tt.path, tt.size); got < tt.min || got > tt.max {
+			t.Errorf("%s: unallocated = %d, want %d-%d", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestDiskLedgerWaits(t *testing.T) {
+	dir := t.TempDir()
+	free, err := getDiskFreeSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leaves room for one 12 MiB download but not for two
+	ledger := newDiskLedger(dir, free-20<<20)
+	release, err := ledger.reserve(context.Background(), filepath.Join(dir, "1.mp4"), 12<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		release, err := ledger.reserve(context.Background(), filepath.Join(dir, "2.mp4"), 12<<20)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("second download did not wait: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	release()
+	release() // releasing twice is harmless
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second download still waits after the first one released its space")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := ledger.reserve(ctx, filepath.Join(dir, "3.mp4"), 1<<50); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the context error", err)
+	}
+
+	var none *diskLedger
+	if release, err := none.reserve(ctx, filepath.Join(dir, "4.mp4"), 1<<50); err != nil {
+		t.Error(err)
+	} else {
+		release()
+	}
+}
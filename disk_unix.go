@@ -5,6 +5,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 )
 
@@ -14,4 +15,13 @@ func getDiskFreeSpace(path string) (int64, error) {
         return 0, fmt.Errorf("statfs on %q: %w", path, err)
     }
 	return int64(statfs.Bavail) * int64(statfs.Bsize), nil
-}
\ No newline at end of file
+}
+
+// allocatedSize is how much disk space a file takes up, less than its size
+// while a sparse, preallocated file is being written.
+func allocatedSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+	return info.Size()
+}
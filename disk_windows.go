@@ -5,6 +5,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"golang.org/x/sys/windows"
 )
@@ -22,4 +23,10 @@ func getDiskFreeSpace(path string) (int64, error) {
 	}
 
 	return int64(freeBytes), nil
-}
\ No newline at end of file
+}
+
+// allocatedSize is how much disk space a file takes up. Extending a file on
+// Windows allocates the space right away.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
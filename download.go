@@ -4,11 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
+	"sync/atomic"
 
 	"github.com/vbauerster/mpb/v8"
 	"golang.org/x/sync/errgroup"
@@ -19,161 +20,359 @@ const (
     maxRetries = 3
 )
 
-// safeCreateFile ensures destPath is within baseDir and that there is enough free space.
+// safeCreateFile ensures destPath is within baseDir and preallocates a file of
+// size bytes there. Free space is left to the disk ledger, which waits for it
+// before the download starts.
 func safeCreateFile(destPath, baseDir string, size int64) (*os.File, error) {
-    cleanDest := filepath.Clean(destPath)
-
-    absBase, err := filepath.Abs(baseDir)
+    _, absDest, err := safeDestPath(destPath, baseDir)
     if err != nil {
-        return nil, fmt.Errorf("resolving base dir: %w", err)
+        return nil, err
     }
-    absDest, err := filepath.Abs(cleanDest)
+
+    outFile, err := os.Create(absDest)
     if err != nil {
-        return nil, fmt.Errorf("resolving dest path: %w", err)
+        return nil, fmt.Errorf("creating file: %w", err)
+    }
+    if err := outFile.Truncate(size); err != nil {
+        outFile.Close()
+        return nil, fmt.Errorf("preallocating file: %w", err)
     }
+    return outFile, nil
+}
 
-    rel, err := filepath.Rel(absBase, absDest)
+// safeOpenFile opens an existing file below baseDir for resuming a download.
+func safeOpenFile(destPath, baseDir string) (*os.File, error) {
+    _, absDest, err := safeDestPath(destPath, baseDir)
     if err != nil {
-        return nil, fmt.Errorf("resolving relative path: %w", err)
+        return nil, err
     }
-    if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-        return nil, fmt.Errorf("destination %q is outside of %q", absDest, absBase)
+    outFile, err := os.OpenFile(absDest, os.O_RDWR, 0)
+    if err != nil {
+        return nil, fmt.Errorf("opening file: %w", err)
     }
+    return outFile, nil
+}
+
+// safeDestPath resolves destPath and makes sure it does not escape baseDir.
+func safeDestPath(destPath, baseDir string) (absBase, absDest string, err error) {
+    cleanDest := filepath.Clean(destPath)
 
-    freeBytes, err := getDiskFreeSpace(absBase)
+    absBase, err = filepath.Abs(baseDir)
     if err != nil {
-        return nil, fmt.Errorf("%w", err)
+        return "", "", fmt.Errorf("resolving base dir: %w", err)
     }
-    if freeBytes < size {
-        return nil, fmt.Errorf("not enough disk space: need %d, have %d", size, freeBytes)
+    absDest, err = filepath.Abs(cleanDest)
+    if err != nil {
+        return "", "", fmt.Errorf("resolving dest path: %w", err)
     }
 
-    outFile, err := os.Create(absDest)
+    rel, err := filepath.Rel(absBase, absDest)
     if err != nil {
-        return nil, fmt.Errorf("creating file: %w", err)
+        return "", "", fmt.Errorf("resolving relative path: %w", err)
     }
-    if err := outFile.Truncate(size); err != nil {
-        outFile.Close()
-        return nil, fmt.Errorf("preallocating file: %w", err)
+    if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+        return "", "", fmt.Errorf("destination %q is outside of %q", absDest, absBase)
     }
-    return outFile, nil
+    return absBase, absDest, nil
 }
 
-// DownloadVideo downloads `url` into `destPath` with up to `concurrency` workers.
-func DownloadVideo(ctx context.Context, url, destPath, baseDir string, concurrency int, bar *mpb.Bar) error {
-    // 1. HEAD to get length and check range support
+// downloadOptions controls how DownloadVideo fetches a file.
+type downloadOptions struct {
+    Chunks   int                 // parallel range requests per file
+    Limiter  *rateLimiter        // shared bandwidth limit, nil for unlimited
+    Adaptive *adaptiveController // picks Chunks per file when set
+    Hash     *hashSet            // receives the file contents in order, nil to skip hashing
+    Client   *http.Client        // shared download client, http.DefaultClient if nil
+    Retries  *atomic.Int64       // counts retried requests when set
+}
+
+func (o downloadOptions) client() *http.Client {
+    if o.Client == nil {
+        return http.DefaultClient
+    }
+    return o.Client
+}
+
+func (o downloadOptions) retried(err error) {
+    stats.observeRetry(err)
+    if o.Retries != nil {
+        o.Retries.Add(1)
+    }
+}
+
+// probeVideo sends a HEAD request for `url` to learn its length and whether it can be fetched in ranges.
+func probeVideo(ctx context.Context, url string, opts downloadOptions) (length int64, supportRanges bool, err error) {
     req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
     if err != nil {
-        return fmt.Errorf("creating HEAD request: %w", err)
+        return 0, false, fmt.Errorf("creating HEAD request: %w", err)
     }
-    resp, err := http.DefaultClient.Do(req)
+    resp, err := opts.client().Do(req)
     if err != nil {
-        return fmt.Errorf("HEAD request failed: %w", err)
+        return 0, false, fmt.Errorf("HEAD request failed: %w", err)
     }
     resp.Body.Close()
+    stats.observeResponse("download", resp.StatusCode)
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("HEAD returned %s", resp.Status)
+        return 0, false, fmt.Errorf("HEAD returned %s", resp.Status)
     }
-    length := resp.ContentLength
+    length = resp.ContentLength
     if length <= 0 || length > maxAllowedSize {
-        return fmt.Errorf("invalid or too large content length: %d", length)
+        return 0, false, fmt.Errorf("invalid or too large content length: %d", length)
     }
+    return length, resp.Header.Get("Accept-Ranges") == "bytes", nil
+}
 
-    acceptRanges := resp.Header.Get("Accept-Ranges")
-    supportRanges := acceptRanges == "bytes"
+// DownloadVideo downloads `url` into `destPath` with up to `opts.Chunks` workers.
+func DownloadVideo(ctx context.Context, url, destPath, baseDir string, opts downloadOptions, bar *mpb.Bar) error {
+    // 1. HEAD to get length and check range support
+    length, supportRanges, err := probeVideo(ctx, url, opts)
+    if err != nil {
+        return err
+    }
 
-    // 2. Prepare output file (or fall back to streaming if no range support)
-    outFile, err := safeCreateFile(destPath, baseDir, length)
+    // 2. Prepare output file, resuming an interrupted download if it left a checkpoint
+    var chunks []*chunk
+    if supportRanges {
+        chunks = loadCheckpoint(destPath, length)
+    }
+    var outFile *os.File
+    if chunks != nil {
+        slog.Debug("Resuming download from checkpoint", "file", destPath, "chunks", len(chunks))
+        outFile, err = safeOpenFile(destPath, baseDir)
+    } else {
+        removeCheckpoint(destPath)
+        outFile, err = safeCreateFile(destPath, baseDir, length)
+    }
     if err != nil {
         return err
     }
     defer outFile.Close()
+    stats.activeDownloads.Add(1)
+    defer stats.activeDownloads.Add(-1)
 
-    // If server doesn't support ranges, just stream it
-    if !supportRanges || concurrency <= 1 {
-        return singleDownload(ctx, url, outFile, bar)
+    concurrency := opts.Chunks
+    if opts.Adaptive != nil {
+        concurrency = opts.Adaptive.Chunks()
     }
-
-    // 3. Split into chunks
-    partSize := length / int64(concurrency)
-    eg, ctx := errgroup.WithContext(ctx)
-
-    for i := range concurrency {
-        start := int64(i) * partSize
-        end := start + partSize - 1
-        if i == concurrency-1 {
-            end = length - 1
+    if chunks != nil {
+        var resumed int64
+        for _, c := range chunks {
+            resumed += c.offset.Load() - c.start
+        }
+        bar.IncrInt64(resumed)
+    } else if !supportRanges || concurrency <= 1 {
+        // If server doesn't support ranges, just stream it
+        return singleDownload(ctx, url, outFile, length, opts, bar)
+    } else {
+        // 3. Split into chunks
+        partSize := length / int64(concurrency)
+        chunks = make([]*chunk, concurrency)
+        for i := range concurrency {
+            start := int64(i) * partSize
+            end := start + partSize - 1
+            if i == concurrency-1 {
+                end = length - 1
+            }
+            chunks[i] = newChunk(start, end)
         }
+    }
 
-        // capture for closure
-        chunkStart, chunkEnd := start, end
+    // 4. Hash the contiguous prefix of the file while the chunks are still downloading
+    var cursorErr chan error
+    workersDone := make(chan struct{})
+    if opts.Hash != nil {
+        cursor := &hashCursor{h: opts.Hash, file: outFile, chunks: chunks, length: length}
+        cursorErr = make(chan error, 1)
+        go func() {
+            cursorErr <- cursor.follow(ctx, workersDone)
+        }()
+    }
 
+    eg, egCtx := errgroup.WithContext(ctx)
+    for _, c := range chunks {
+        if c.offset.Load() > c.end {
+            continue // finished before the download was interrupted
+        }
         eg.Go(func() error {
-            var lastErr error
-            for attempt := range maxRetries {
-                if err := downloadChunk(ctx, url, outFile, chunkStart, chunkEnd, bar); err != nil {
-                    lastErr = err
-                    time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
-                    continue
-                }
-                return nil
-            }
-            return fmt.Errorf("chunk %d-%d failed after %d attempts: %w", chunkStart, chunkEnd, maxRetries, lastErr)
+            return fetchChunk(egCtx, url, outFile, c, opts, bar)
         })
     }
 
-    return eg.Wait()
+    err = eg.Wait()
+    close(workersDone)
+    if cursorErr != nil {
+        if hashErr := <-cursorErr; err == nil && hashErr != nil {
+            err = fmt.Errorf("hashing: %w", hashErr)
+        }
+    }
+    if err != nil {
+        // keep what was downloaded so far for the next attempt
+        if cpErr := saveCheckpoint(destPath, length, chunks); cpErr != nil {
+            return fmt.Errorf("%w (saving checkpoint: %v)", err, cpErr)
+        }
+        slog.Debug("Saved checkpoint", "file", destPath)
+        return err
+    }
+    removeCheckpoint(destPath)
+    return nil
+}
+
+// chunkWriter is what chunks are written to: the output file, or the buffer of an upload part.
+type chunkWriter interface {
+    io.WriterAt
+    Name() string
+}
+
+// chunk is the byte range [start, end] of the output file handled by one worker.
+// offset is the next byte that has not been written yet, so a retry only fetches
+// the unfinished tail and the hash cursor knows how far the chunk is on disk.
+type chunk struct {
+    start, end int64
+    offset     atomic.Int64
+}
+
+func newChunk(start, end int64) *chunk {
+    c := &chunk{start: start, end: end}
+    c.offset.Store(start)
+    return c
+}
+
+// fetchChunk downloads a chunk, retrying with backoff. Only attempts that made
+// no progress count towards maxRetries.
+func fetchChunk(ctx context.Context, url string, outFile chunkWriter, c *chunk, opts downloadOptions, bar *mpb.Bar) error {
+    var lastErr error
+    for attempt := 0; attempt < maxRetries; {
+        before := c.offset.Load()
+        err := downloadChunk(ctx, url, outFile, c, opts, bar)
+        if err == nil {
+            return nil
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        lastErr = err
+        opts.Adaptive.ReportError(err)
+        if c.offset.Load() == before {
+            attempt++
+        } else {
+            attempt = 0
+        }
+        if attempt >= maxRetries {
+            break
+        }
+        opts.retried(err)
+        delay := retryDelay(attempt, err)
+        slog.Warn("Retrying chunk", "file", outFile.Name(), "start", c.start, "end", c.end, "offset", c.offset.Load(), "attempt", attempt, "reason", retryReason(err), "delay", delay, "err", err)
+        if err := sleepContext(ctx, delay); err != nil {
+            return err
+        }
+    }
+    return fmt.Errorf("chunk %d-%d failed at offset %d after %d attempts: %w", c.start, c.end, c.offset.Load(), maxRetries, lastErr)
+}
+
+// singleDownload streams the entire file when ranges aren’t supported.
+// Without ranges a failed attempt has to start over, so its progress is rolled back.
+func singleDownload(ctx context.Context, url string, outFile *os.File, length int64, opts downloadOptions, bar *mpb.Bar) error {
+    var lastErr error
+    for attempt := range maxRetries {
+        c := newChunk(0, length-1)
+        if opts.Hash != nil {
+            opts.Hash.Reset()
+        }
+        err := singleDownloadAttempt(ctx, url, outFile, c, opts, bar)
+        if err == nil {
+            return nil
+        }
+        bar.IncrInt64(-c.offset.Load())
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        lastErr = err
+        opts.Adaptive.ReportError(err)
+        if attempt == maxRetries-1 {
+            break
+        }
+        opts.retried(err)
+        delay := retryDelay(attempt, err)
+        slog.Warn("Retrying download", "file", outFile.Name(), "attempt", attempt+1, "reason", retryReason(err), "delay", delay, "err", err)
+        if err := sleepContext(ctx, delay); err != nil {
+            return err
+        }
+    }
+    return fmt.Errorf("download failed after %d attempts: %w", maxRetries, lastErr)
 }
 
-// singleDownload streams the entire file when ranges aren’t supported
-func singleDownload(ctx context.Context, url string, outFile *os.File, bar *mpb.Bar) error {
+func singleDownloadAttempt(ctx context.Context, url string, outFile *os.File, c *chunk, opts downloadOptions, bar *mpb.Bar) error {
     req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-    resp, err := http.DefaultClient.Do(req)
+    stats.activeChunks.Add(1)
+    defer stats.activeChunks.Add(-1)
+    resp, err := opts.client().Do(req)
     if err != nil {
         return err
     }
     defer resp.Body.Close()
+    stats.observeResponse("download", resp.StatusCode)
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("download failed: %s", resp.Status)
+        return newStatusError(resp)
+    }
+    var body io.Reader = resp.Body
+    if opts.Hash != nil {
+        // a single stream arrives in order, so it can be hashed as it is read
+        body = io.TeeReader(body, opts.Hash)
     }
-    reader := bar.ProxyReader(resp.Body)
-    _, err = io.Copy(outFile, reader)
-    return err
+    body = newLimitedReader(ctx, opts.Adaptive.reader(body), opts.Limiter)
+    return writeChunk(body, outFile, c, bar)
 }
 
-// downloadChunk fetches a single byte range [start–end] and writes it at the right offset.
-func downloadChunk(ctx context.Context, url string, outFile *os.File, start, end int64, bar *mpb.Bar) error {
+// downloadChunk fetches the unfinished part [offset–end] of a chunk and writes it at the right offset.
+func downloadChunk(ctx context.Context, url string, outFile chunkWriter, c *chunk, opts downloadOptions, bar *mpb.Bar) error {
+    start := c.offset.Load()
     req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-    req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+    req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, c.end))
 
-    resp, err := http.DefaultClient.Do(req)
+    stats.activeChunks.Add(1)
+    defer stats.activeChunks.Add(-1)
+    resp, err := opts.client().Do(req)
     if err != nil {
         return err
     }
     defer resp.Body.Close()
+    stats.observeResponse("download", resp.StatusCode)
 
     // insist on 206 Partial Content
     if resp.StatusCode != http.StatusPartialContent {
-        return fmt.Errorf("expected 206 for range %d-%d, got %d", start, end, resp.StatusCode)
+        return fmt.Errorf("range %d-%d: %w", start, c.end, newStatusError(resp))
+    }
+
+    body := newLimitedReader(ctx, opts.Adaptive.reader(io.LimitReader(resp.Body, c.end-start+1)), opts.Limiter)
+    if err := writeChunk(body, outFile, c, bar); err != nil {
+        return err
+    }
+    if c.offset.Load() <= c.end {
+        return fmt.Errorf("range %d-%d: short body, stopped at %d: %w", start, c.end, c.offset.Load(), io.ErrUnexpectedEOF)
     }
-    
-    reader := bar.ProxyReader(resp.Body)
+    return nil
+}
+
+// writeChunk copies r to outFile from the chunk's offset onwards, advancing the
+// offset and the bar only by bytes that actually reached the file.
+func writeChunk(r io.Reader, outFile chunkWriter, c *chunk, bar *mpb.Bar) error {
     buf := make([]byte, 32*1024)
-    offset := start
     for {
-        n, readErr := reader.Read(buf)
+        n, readErr := r.Read(buf)
         if n > 0 {
-            if _, writeErr := outFile.WriteAt(buf[:n], offset); writeErr != nil {
+            if _, writeErr := outFile.WriteAt(buf[:n], c.offset.Load()); writeErr != nil {
                 return writeErr
             }
-            offset += int64(n)
+            c.offset.Add(int64(n))
+            bar.IncrBy(n)
+            stats.downloadedBytes.Add(int64(n))
         }
         if readErr == io.EOF {
-            break
+            return nil
         }
         if readErr != nil {
             return readErr
         }
     }
-    return nil
 }
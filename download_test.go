@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+)
+
+func TestDownloadVideoResume(t *testing.T) {
+	video := make([]byte, 9000)
+	for i := range video {
+		video[i] = byte(i * 7)
+	}
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(video))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "169.mp4")
+	// what an interrupted download leaves behind: the first chunk is finished,
+	// the second one got to 4500 and the third one never started
+	partial := make([]byte, len(video))
+	copy(partial[:4500], video[:4500])
+	if err := os.WriteFile(path, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunks := []*chunk{newChunk(0, 2999), newChunk(3000, 5999), newChunk(6000, 8999)}
+	chunks[0].offset.Store(3000)
+	chunks[1].offset.Store(4500)
+	if err := saveCheckpoint(path, int64(len(video)), chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	bar := mpb.New(mpb.WithOutput(nil)).New(0, mpb.NopStyle())
+	hashes, _ := newHashSet("sha256")
+	if err := DownloadVideo(context.Background(), server.URL, path, dir, downloadOptions{Chunks: 3, Hash: hashes}, bar); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, video) {
+		t.Error("resumed file differs from the video")
+	}
+	slices.Sort(ranges)
+	if want := []string{"bytes=4500-5999", "bytes=6000-8999"}; !slices.Equal(ranges, want) {
+		t.Errorf("requested ranges %q, want %q", ranges, want)
+	}
+	if hasCheckpoint(path) {
+		t.Error("checkpoint left after the download finished")
+	}
+	sums, _ := checksum(path, "sha256")
+	if hashes.Sums()["sha256"] != sums["sha256"] {
+		t.Error("hash of the resumed download does not cover the whole file")
+	}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1.mp4")
+	if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		chunks [][3]int64 // start, end, offset
+		ok     bool
+	}{
+		{"finished and partial", [][3]int64{{0, 49, 50}, {50, 99, 70}}, true},
+		{"untouched", [][3]int64{{0, 99, 0}}, true},
+		{"gap", [][3]int64{{0, 49, 50}, {60, 99, 60}}, false},
+		{"short", [][3]int64{{0, 49, 50}}, false},
+		{"offset past end", [][3]int64{{0, 49, 51}, {50, 99, 50}}, false},
+		{"offset before start", [][3]int64{{0, 49, 0}, {50, 99, 10}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chunks []*chunk
+			for _, c := range tt.chunks {
+				chunks = append(chunks, newChunk(c[0], c[1]))
+				chunks[len(chunks)-1].offset.Store(c[2])
+			}
+			if err := saveCheckpoint(path, 100, chunks); err != nil {
+				t.Fatal(err)
+			}
+			loaded := loadCheckpoint(path, 100)
+			if (loaded != nil) != tt.ok {
+				t.Fatalf("loaded %d chunks, want ok = %v", len(loaded), tt.ok)
+			}
+			for i, c := range loaded {
+				if c.start != tt.chunks[i][0] || c.end != tt.chunks[i][1] || c.offset.Load() != tt.chunks[i][2] {
+					t.Errorf("chunk %d = %d-%d at %d, want %v", i, c.start, c.end, c.offset.Load(), tt.chunks[i])
+				}
+			}
+		})
+	}
+}
@@ -7,7 +7,9 @@ require (
 	github.com/chromedp/chromedp v0.13.7
 	github.com/fatih/color v1.18.0
 	github.com/joho/godotenv v1.5.1
+	github.com/pkg/sftp v1.13.9
 	github.com/vbauerster/mpb/v8 v8.10.2
+	golang.org/x/crypto v0.37.0
 	golang.org/x/sync v0.15.0
 	golang.org/x/sys v0.33.0
 )
@@ -22,6 +24,7 @@ require (
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.4.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
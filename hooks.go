@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	eventCallDiscovered = "call.discovered" // a call is listed that was not listed before (watch mode)
+	eventCallDownloaded = "call.downloaded"
+	eventHashMismatch   = "hash.mismatch"
+	eventRunFailed      = "run.failed"
+	eventRunSummary     = "run.summary"
+)
+
+var hookEvents = []string{eventCallDiscovered, eventCallDownloaded, eventHashMismatch, eventRunFailed, eventRunSummary}
+
+const (
+	defaultHookTimeout = 30 * time.Second
+	hookAttempts       = 3 // for webhooks
+)
+
+// hookConfig is an entry of the "hooks" list of the config file. A hook either
+// posts to URL or runs Command, e.g.
+//
+//	{"events": ["call.downloaded"], "url": "https://discord.com/api/webhooks/...",
+//	 "body": "{\"content\": {{json (printf \"Downloaded %d\" .LiveId)}}}"}
+//	{"events": ["*"], "command": ["/usr/local/bin/notify"]}
+type hookConfig struct {
+	Events  []string          `json:"events"`            // event names, or "*" for all
+	URL     string            `json:"url,omitempty"`     // webhook to send the event to
+	Method  string            `json:"method,omitempty"`  // POST by default
+	Headers map[string]string `json:"headers,omitempty"` // extra request headers
+	Body    string            `json:"body,omitempty"`    // text/template for the body, the event JSON by default
+	Command []string          `json:"command,omitempty"` // program and arguments, gets the event JSON on stdin
+	Timeout string            `json:"timeout,omitempty"` // per attempt, 30s by default
+}
+
+// hookEvent is what hooks receive. Fields that do not apply to an event are omitted.
+type hookEvent struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	LiveId int       `json:"liveId,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	File   string    `json:"file,omitempty"`
+	Error  string    `json:"error,omitempty"`
+
+	// run.summary
+	Listed     int    `json:"listed,omitempty"`
+	Downloaded int    `json:"downloaded,omitempty"`
+	Duration   string `json:"duration,omitempty"`
+	Paused     bool   `json:"paused,omitempty"`
+}
+
+type hook struct {
+	events  []string
+	url     string
+	method  string
+	headers map[string]string
+	body    *template.Template
+	command []string
+	timeout time.Duration
+}
+
+// hooks delivers events to the configured hooks in the background. A nil
+// *hooks has no hooks.
+type hooks struct {
+	client *http.Client
+	list   []*hook
+	wg     sync.WaitGroup
+}
+
+var hookFuncs = template.FuncMap{
+	// json encodes a value, e.g. to put a string into a JSON body
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"size": formatByteSize,
+}
+
+func newHooks(configs []hookConfig, client *http.Client) (*hooks, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	h := &hooks{client: client}
+	for i, cfg := range configs {
+		if (cfg.URL == "") == (len(cfg.Command) == 0) {
+			return nil, fmt.Errorf("hook %d needs either a url or a command", i+1)
+		}
+		if len(cfg.Events) == 0 {
+			return nil, fmt.Errorf("hook %d has no events", i+1)
+		}
+		for _, event := range cfg.Events {
+			if event != "*" && !slices.Contains(hookEvents, event) {
+				return nil, fmt.Errorf("hook %d: unknown event %q, expected one of %s or *", i+1, event, strings.Join(hookEvents, ", "))
+			}
+		}
+		hk := &hook{events: cfg.Events, url: cfg.URL, method: cfg.Method, headers: cfg.Headers, command: cfg.Command, timeout: defaultHookTimeout}
+		if hk.method == "" {
+			hk.method = http.MethodPost
+		}
+		if cfg.Timeout != "" {
+			d, err := time.ParseDuration(cfg.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("hook %d: invalid timeout %q", i+1, cfg.Timeout)
+			}
+			hk.timeout = d
+		}
+		if cfg.Body != "" {
+			tmpl, err := template.New(fmt.Sprintf("hook %d", i+1)).Funcs(hookFuncs).Option("missingkey=error").Parse(cfg.Body)
+			if err != nil {
+				return nil, fmt.Errorf("hook %d: invalid body template: %w", i+1, err)
+			}
+			hk.body = tmpl
+		}
+		h.list = append(h.list, hk)
+	}
+	return h, nil
+}
+
+// fire sends an event to every hook that wants it, without waiting for them.
+func (h *hooks) fire(e hookEvent) {
+	if h == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, hk := range h.list {
+		if !slices.Contains(hk.events, e.Event) && !slices.Contains(hk.events, "*") {
+			continue
+		}
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			if err := h.deliver(hk, e); err != nil {
+				slog.Warn("Hook failed", "event", e.Event, "hook", hk.name(), "err", err)
+			}
+		}()
+	}
+}
+
+// wait blocks until every fired event has been delivered or has failed.
+func (h *hooks) wait() {
+	if h == nil {
+		return
+	}
+	h.wg.Wait()
+}
+
+// fail fires run.failed for err, waits for the hooks and exits like fatal.
+func (h *hooks) fail(msg string, err error) {
+	h.fire(hookEvent{Event: eventRunFailed, Error: err.Error()})
+	h.wait()
+	fatal(msg, "err", err)
+}
+
+func (hk *hook) name() string {
+	if hk.url != "" {
+		// the path of a webhook URL is often its secret
+		if u, err := url.Parse(hk.url); err == nil {
+			return u.Scheme + "://" + u.Host
+		}
+		return "webhook"
+	}
+	return hk.command[0]
+}
+
+func (h *hooks) deliver(hk *hook, e hookEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	body := payload
+	if hk.body != nil {
+		var buf bytes.Buffer
+		if err := hk.body.Execute(&buf, e); err != nil {
+			return fmt.Errorf("rendering body: %w", err)
+		}
+		body = buf.Bytes()
+	}
+	if hk.url == "" {
+		// commands are not retried, they may have done part of their work
+		return hk.run(e, payload)
+	}
+	var lastErr error
+	for attempt := range hookAttempts {
+		if attempt > 0 {
+			time.Sleep(retryDelay(attempt-1, lastErr))
+		}
+		if lastErr = h.post(hk, e, body); lastErr == nil {
+			slog.Debug("Hook delivered", "event", e.Event, "hook", hk.name())
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func (h *hooks) post(hk *hook, e hookEvent, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hk.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, hk.method, hk.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Phoning-Event", e.Event)
+	for k, v := range hk.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newStatusError(resp)
+	}
+	return nil
+}
+
+func (hk *hook) run(e hookEvent, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hk.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hk.command[0], hk.command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "PHONING_EVENT="+e.Event)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+		}
+		return err
+	}
+	return nil
+}
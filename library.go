@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const libraryIndexName = ".phoning-library.json"
+
+// libraryIndex records what is known about the call files in an output
+// directory. Hashes are cached together with the size, modification time and
+// inode they were computed for, so unchanged files don't have to be hashed again.
+type libraryIndex struct {
+	mu   sync.Mutex
+	path string
+
+	Calls map[string]*libraryEntry `json:"calls"`
+}
+
+type libraryEntry struct {
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"modTime"`
+	Inode    uint64            `json:"inode,omitempty"`
+	Hashed   time.Time         `json:"hashed"`
+	Hashes   map[string]string `json:"hashes"`
+	Mismatch string            `json:"mismatch,omitempty"` // how the file differs from the manifest, empty if it matches
+	Copies   []remoteCopy      `json:"copies,omitempty"`
+	Deleted  bool              `json:"deleted,omitempty"` // the local file was deleted once it had been uploaded
+}
+
+// remoteCopy is a copy of a call file on an upload target.
+type remoteCopy struct {
+	Target   string    `json:"target"`   // name of the upload target
+	Location string    `json:"location"` // URL of the file, without credentials
+	Size     int64     `json:"size"`
+	Verified string    `json:"verified"` // how the copy was checked: size or sha256
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// loadLibraryIndex reads the index of dir, starting an empty one if there is none.
+func loadLibraryIndex(dir string) (*libraryIndex, error) {
+	index := &libraryIndex{
+		path:  filepath.Join(dir, libraryIndexName),
+		Calls: make(map[string]*libraryEntry),
+	}
+	data, err := os.ReadFile(index.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	if index.Calls == nil {
+		index.Calls = make(map[string]*libraryEntry)
+	}
+	return index, nil
+}
+
+func (l *libraryIndex) save() error {
+	l.mu.Lock()
+	data, err := json.MarshalIndent(l, "", "  ")
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// cachedHashes returns the hashes recorded for a file if it has not changed since,
+// and all requested algorithms are present.
+func (l *libraryIndex) cachedHashes(liveIdStr string, info os.FileInfo, algorithms []string) (map[string]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.Calls[liveIdStr]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) || entry.Inode != fileID(info) {
+		return nil, false
+	}
+	for _, name := range algorithms {
+		if _, ok := entry.Hashes[name]; !ok {
+			return nil, false
+		}
+	}
+	return entry.Hashes, true
+}
+
+// record stores freshly computed hashes of a file, keeping its remote copies.
+// mismatch is how the file differs from its manifest entry, if it does.
+func (l *libraryIndex) record(liveIdStr string, info os.FileInfo, hashes map[string]string, mismatch error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var copies []remoteCopy
+	if previous, ok := l.Calls[liveIdStr]; ok {
+		copies = previous.Copies
+	}
+	entry := &libraryEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Inode:   fileID(info),
+		Hashed:  time.Now(),
+		Hashes:  hashes,
+		Copies:  copies,
+	}
+	if mismatch != nil {
+		entry.Mismatch = mismatch.Error()
+	}
+	l.Calls[liveIdStr] = entry
+}
+
+// setMismatch records whether a file still matches its manifest entry, e.g.
+// when cached hashes are checked against an updated manifest.
+func (l *libraryIndex) setMismatch(liveIdStr string, mismatch error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.Calls[liveIdStr]; ok {
+		entry.Mismatch = ""
+		if mismatch != nil {
+			entry.Mismatch = mismatch.Error()
+		}
+	}
+}
+
+// addCopy records that a call has been uploaded to a target, replacing an
+// earlier copy on the same target.
+func (l *libraryIndex) addCopy(liveIdStr string, c remoteCopy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.Calls[liveIdStr]
+	if !ok {
+		return
+	}
+	entry.Copies = slices.DeleteFunc(entry.Copies, func(old remoteCopy) bool { return old.Target == c.Target })
+	entry.Copies = append(entry.Copies, c)
+}
+
+// copyOn returns the copy of a call on a target, if it has been uploaded there.
+func (l *libraryIndex) copyOn(liveIdStr, target string) (remoteCopy, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.Calls[liveIdStr]; ok {
+		for _, c := range entry.Copies {
+			if c.Target == target {
+				return c, true
+			}
+		}
+	}
+	return remoteCopy{}, false
+}
+
+// markDeleted records that the local file of a call was deleted after it had been uploaded.
+func (l *libraryIndex) markDeleted(liveIdStr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.Calls[liveIdStr]; ok {
+		entry.Deleted = true
+	}
+}
+
+// deleted reports whether a call only has remote copies left.
+func (l *libraryIndex) deleted(liveIdStr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.Calls[liveIdStr]
+	return ok && entry.Deleted
+}
+
+// has reports whether a call has been recorded as downloaded. A file known to
+// differ from the manifest does not count.
+func (l *libraryIndex) has(liveIdStr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.Calls[liveIdStr]
+	return ok && entry.Mismatch == ""
+}
+
+func (l *libraryIndex) forget(liveIdStr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.Calls, liveIdStr)
+}
+
+// recorded returns the hashes last recorded for a call, or nil.
+func (l *libraryIndex) recorded(liveIdStr string) map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.Calls[liveIdStr]; ok {
+		return entry.Hashes
+	}
+	return nil
+}
+
+// verifyFile checks a call file against its manifest entry. Unless full is set,
+// hashes cached in the index are used when the file has not changed. mismatch
+// describes how the file differs from the entry; err is only set if the file
+// could not be read. A mismatching file is recorded with its mismatch, so it is
+// not taken for downloaded.
+func (l *libraryIndex) verifyFile(path, liveIdStr string, entry manifestEntry, full bool) (cached bool, mismatch, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, nil, err
+	}
+	if entry.Size > 0 && info.Size() != entry.Size {
+		l.forget(liveIdStr)
+		mismatch = entry.verify(info.Size(), nil)
+		stats.observeVerification(mismatch, nil)
+		slog.Debug("File size does not match", "liveId", liveIdStr, "file", path, "size", info.Size(), "expected", entry.Size)
+		return false, mismatch, nil
+	}
+	algorithms := entry.algorithms()
+	if !full {
+		if hashes, ok := l.cachedHashes(liveIdStr, info, algorithms); ok {
+			mismatch = entry.verify(info.Size(), hashes)
+			l.setMismatch(liveIdStr, mismatch)
+			return true, mismatch, nil
+		}
+	}
+	hashes, err := checksum(path, algorithms...)
+	if err != nil {
+		stats.observeVerification(nil, err)
+		return false, nil, err
+	}
+	mismatch = entry.verify(info.Size(), hashes)
+	l.record(liveIdStr, info, hashes, mismatch)
+	stats.observeVerification(mismatch, nil)
+	slog.Debug("Hashed file", "liveId", liveIdStr, "file", path, "match", mismatch == nil)
+	return false, mismatch, nil
+}
+
+// recordFile stores hashes that are already known for a file, e.g. from a verified download.
+func (l *libraryIndex) recordFile(path, liveIdStr string, hashes map[string]string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	l.record(liveIdStr, info, hashes, nil)
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/vbauerster/mpb/v8"
+)
+
+const (
+	logFileMaxSize    = 10 << 20 // bytes before the log file is rotated
+	logFileMaxBackups = 5        // rotated files kept as <file>.1 to <file>.5
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+type logConfig struct {
+	Level  string
+	File   string
+	Format string
+}
+
+// addLogFlags registers the logging flags on flags. The returned function
+// collects their values after parsing.
+func addLogFlags(flags *flag.FlagSet) func() logConfig {
+	level := flags.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
+	file := flags.String("log-file", "", "Also log to this file, rotated at 10 MiB")
+	format := flags.String("log-format", "text", "Log format: text or json")
+	return func() logConfig {
+		return logConfig{Level: *level, File: *file, Format: *format}
+	}
+}
+
+// setupLogging makes slog, and the log package through it, write to the
+// console and optionally to a log file. The returned function closes the file.
+func setupLogging(cfg logConfig) (func(), error) {
+	level, ok := logLevels[strings.ToLower(cfg.Level)]
+	if !ok {
+		return nil, fmt.Errorf("invalid -log-level %q", cfg.Level)
+	}
+	if cfg.Format != "text" && cfg.Format != "json" {
+		return nil, fmt.Errorf("invalid -log-format %q", cfg.Format)
+	}
+	newHandler := func(w io.Writer) slog.Handler {
+		opts := &slog.HandlerOptions{Level: level}
+		if cfg.Format == "json" {
+			return slog.NewJSONHandler(w, opts)
+		}
+		return slog.NewTextHandler(w, opts)
+	}
+	handlers := teeHandler{newHandler(console)}
+	closeFile := func() {}
+	if cfg.File != "" {
+		file, err := openRotatingFile(cfg.File, logFileMaxSize, logFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, newHandler(file))
+		closeFile = func() { file.Close() }
+	}
+	slog.SetDefault(slog.New(handlers))
+	return closeFile, nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// console is where log lines for the terminal go: stderr, or the progress bars
+// that are being drawn so lines appear above them instead of through them.
+var console = &consoleWriter{w: os.Stderr}
+
+type consoleWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *consoleWriter) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.w.Write(b)
+	if errors.Is(err, mpb.ErrDone) {
+		// the bars are gone already
+		return os.Stderr.Write(b)
+	}
+	return n, err
+}
+
+// logAbove sends console log lines through p while it draws bars. The returned
+// function undoes that and has to be called after p.Wait.
+func logAbove(p *mpb.Progress) func() {
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		// bars are only drawn on a terminal, lines written through them would be lost
+		return func() {}
+	}
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	previous := console.w
+	console.w = p
+	return func() {
+		console.mu.Lock()
+		defer console.mu.Unlock()
+		console.w = previous
+	}
+}
+
+// teeHandler passes records on to several handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// rotatingFile is an append-only log file that is renamed to <path>.1 when it
+// reaches maxSize, shifting older ones up to <path>.<backups>.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
@@ -39,9 +39,11 @@ func extractSignupLinks(html string) ([]string, error) {
     return links, nil
 }
 
-func getCookie() (CookieData, *http.Client, error) {
+// getCookie starts an emailnator session. The returned client keeps its cookies
+// and shares the transport of base.
+func getCookie(base *http.Client) (CookieData, *http.Client, error) {
 	jar, _ := cookiejar.New(nil)
-	client := &http.Client{Jar: jar}
+	client := &http.Client{Jar: jar, Transport: base.Transport, Timeout: base.Timeout}
 
 	resp, err := client.Get(baseURL)
 	if err != nil {
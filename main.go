@@ -2,310 +2,319 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/fatih/color"
-	"github.com/joho/godotenv"
 	"github.com/vbauerster/mpb/v8"
-	"github.com/vbauerster/mpb/v8/decor"
 )
 
-const fetchConcurrency = 64
 const warningConcurrency = 15
 
 func main() {
-	callHashFilePath := filepath.Join("hash", "sum.json")
-	outputDir := flag.String("o", "Downloads", "Directory to save downloaded videos")
-	concurrency := flag.Int("c", 10, "Concurrent downloads")
-	chunk := flag.Int("d", 10, "Number of chunks to download in parallel")
-	disableHash := flag.Bool("f", false, "Do not check hash values (might get corrupted files)")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "manifest":
+			manifestCommand(os.Args[2:])
+			return
+		case "repair":
+			repairCommand(os.Args[2:])
+			return
+		case "verify":
+			verifyCommand(os.Args[2:])
+			return
+		case "quarantine":
+			quarantineCommand(os.Args[2:])
+			return
+		case "watch":
+			watchCommand(os.Args[2:])
+			return
+		case "serve":
+			serveCommand(os.Args[2:])
+			return
+		}
+	}
+	config := addDownloadFlags(flag.CommandLine)
+	storageFlag := flag.String("storage", "", "Keep the calls in object storage instead of the output directory, e.g. s3://bucket/prefix")
+	reportFlag := flag.String("report", "", "Also write the run summary to the output directory: json, markdown or json,markdown")
 	help := flag.Bool("h", false, "Show help message")
 	flag.Parse()
 	if *help {
 		flag.Usage()
 		os.Exit(0)
 	}
-	if *concurrency < 1 {
-		log.Fatal("Concurrency must be at least 1")
+	cfg := config()
+	closeLog, err := setupLogging(cfg.Log)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *concurrency > warningConcurrency {
-		color.Yellow("Warning: High concurrency may cause issues. Consider using a lower value.")
+	defer closeLog()
+	if err := cfg.validate(); err != nil {
+		fatal(err.Error())
 	}
-	if *chunk < 1 {
-		log.Fatal("Chunk size must be at least 1")
+	formats, err := parseReportFormats(*reportFlag)
+	if err != nil {
+		fatal(err.Error())
 	}
-	err := godotenv.Load()
+	if cfg.Concurrency > warningConcurrency && !cfg.Adaptive {
+		slog.Warn("High concurrency may cause issues. Consider using a lower value.", "concurrency", cfg.Concurrency)
+	}
+	limiter, err := cfg.rateLimiter()
 	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-	access_token := os.Getenv("ACCESS_TOKEN")
-	generatingAccount := false
-	if access_token == "" {
-		generatingAccount = true
-		println("Access Token not found. Generating...")
-		body, err := register()
-		if err != nil {
-			log.Fatal(err)
-		}
-		email := body["email"]
-		password := body["password"]
-		if email == "" || password == "" {
-			log.Fatal("Email or password not found in registration response")
-		}
-		respBody, err := getToken(email, password)
-		if err != nil {
-			log.Fatal(err)
-		}
-		decodedResponse := make(map[string]any)
-		if err := json.Unmarshal(respBody, &decodedResponse); err != nil {
-			log.Fatalf("Error decoding response: %v", err)
-		}
-		accessToken, ok := decodedResponse["accessToken"].(string)
-		if !ok {
-			log.Fatal("Access token not found in response")
-		}
-		appendEnv("ACCESS_TOKEN", accessToken)
-		print("Access token fetch: ")
-		color.Green("success")
-	}
-	godotenv.Load()
-	println("Checking configurations...")
-	api_key := os.Getenv("API_KEY")
-	print("API key: ")
-	if api_key == "" {
-		color.Red("not found")
-	} else {
-		color.Green("found")
+		fatal(err.Error())
 	}
-	print("Access token: ")
-	access_token = os.Getenv("ACCESS_TOKEN")
-	if access_token == "" {
-		color.Red("not found")
-	} else {
-		color.Green("found")
-	}
-	if api_key == "" || access_token == "" {
-		color.Red("Please check your configurations in the .env file.")
-		os.Exit(1)
-	}
-	if generatingAccount {
-		_, err := phoning("POST", api_key, "", "/fan/v1.0/login", map[string]string{
-			"wevAccessToken": access_token,
-			"tokenType": "APNS",
-			"deviceToken": "",
-		})
-		if err != nil {
-			color.Red("failed\nYou do not have access to the Phoning API. Please check your network connection and API key.")
-			os.Exit(1)
+	disk, err := cfg.diskLedger()
+	if err != nil {
+		fatal(err.Error())
+	}
+	fileCfg, err := loadConfig(cfg.ConfigFile)
+	if err != nil {
+		fatal("Error loading config", "err", err)
+	}
+	sched := &schedule{}
+	if fileCfg.Schedule != nil {
+		// a single run only honours the quiet hours and the maximum runtime, watch uses the triggers
+		if sched, err = newSchedule(*fileCfg.Schedule); err != nil {
+			fatal("Invalid schedule", "err", err)
 		}
 	}
-	print("Checking access to Phoning API... ")
-	_, err = phoning("GET", api_key, access_token, "/fan/v1.0/users/me")
+	if until, quiet := sched.quietUntil(time.Now()); quiet {
+		slog.Info("Quiet hours, waiting", "until", until.Format(time.DateTime))
+		time.Sleep(time.Until(until))
+	}
+	started := time.Now()
+	report := newRunReport(started)
+	clients, err := newHTTPClients(cfg.Transport)
 	if err != nil {
-		color.Red("failed\nYou do not have access to the Phoning API. Please check your network connection, API key, and access token.")
-	} else {
-		color.Green("success")
-		println("You have access to the Phoning API.")
+		fatal("Invalid connection settings", "err", err)
+	}
+	hooks, err := newHooks(fileCfg.Hooks, clients.API)
+	if err != nil {
+		fatal("Invalid hook", "err", err)
+	}
+	store, err := newStorage(*storageFlag, cfg.OutputDir, clients.Download)
+	if err != nil {
+		fatal("Invalid storage", "err", err)
+	}
+	uploads, err := newUploads(fileCfg.Uploads, clients.Download)
+	if err != nil {
+		fatal("Invalid upload", "err", err)
+	}
+	defer closeUploads(uploads)
+	s, err := newSession(clients)
+	if err != nil {
+		hooks.fail("Error starting session", err)
 	}
 	// All ready, safe to proceed
-	if err := os.MkdirAll(*outputDir, 0755); err != nil {
-		log.Fatalf("Failed to create Downloads directory: %v", err)
-	}
-	println("Fetching calls...")
-	var callsData []any = make([]any, 0)
-	nextCursor := ""
-	cnt := 0
-	for {
-		cnt++
-		if cnt > 10 {
-			log.Fatal("Too many iterations, stopping to prevent infinite loop")
-		}
-		params := map[string]string{"limit": "100"}
-		if nextCursor != "" {
-			params["cursor"] = nextCursor
-		}
-		calls, err := phoning("GET", api_key, access_token, "/fan/v1.0/lives", params)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-		callsMap, ok := calls["data"].([]any)
-		if !ok {
-			log.Fatalf("Unexpected data format: %T", calls["data"])
-		}
-		callsData = append(callsData, callsMap...)
-		cursors, ok := calls["cursors"].(map[string]any)
-		if !ok {
-			log.Fatalf("Unexpected cursors format: %T", calls["cursors"])
-		}
-		next, ok := cursors["next"].(string)
-		if !ok {
-			break
-		}
-		nextCursor = next
-	}
-	num := len(callsData)
-	println("Found", num, "calls. Fetching informations...")
-	liveIds := make([]int, num)
-	callsMap := make(map[int](map[string]any), num)
-	for i, call := range callsData {
-		callMap, ok := call.(map[string]any)
-		if !ok {
-			log.Fatalf("Unexpected call format: %T", call)
-		}
-		liveId, ok := callMap["liveId"].(float64)
-		if !ok {
-			log.Fatalf("Live ID not found in call: %v", callMap)
-		}
-		liveIdInt := int(liveId)
-		callsMap[liveIdInt] = callMap
-		liveIds[i] = liveIdInt
-	}
-	p := mpb.New(mpb.WithWidth(64), mpb.PopCompletedMode())
-	bar := p.New(int64(num),
-		mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
-		mpb.PrependDecorators(
-			decor.Name("Fetching...", decor.WC{W: 5, C: decor.DindentRight}),
-			decor.Current(0, "(%d", decor.WC{W: 5}),
-			decor.Total(0, "/%d)", decor.WC{W: 5, C: decor.DindentRight}),
-		),
-		mpb.AppendDecorators(
-			decor.NewPercentage("%.2f", decor.WC{W: 7}),
-		),
-	)
-	fetchFunction := func (liveId int, ctx context.Context) (int64, error) {
-		pnxml, err := getPNXML(api_key, access_token, liveId)
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		fatal("Failed to create Downloads directory", "err", err)
+	}
+	library, err := loadLibraryIndex(cfg.OutputDir)
+	if err != nil {
+		fatal("Error loading library index", "err", err)
+	}
+	stats.watchDisk(cfg.OutputDir)
+	if cfg.Metrics != "" {
+		server, err := serveMetrics(cfg.Metrics)
 		if err != nil {
-			log.Fatalf("Error getting PNXML for live ID %d: %v", liveId, err)
-		}
-		url, ok := pnxml["url"].(string)
-		if !ok {
-			log.Fatalf("PNXML for live ID %d does not contain a valid URL", liveId)
+			fatal(err.Error())
 		}
-		headReq, _ := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
-		resp, err := http.DefaultClient.Do(headReq)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			return 0, fmt.Errorf("HEAD request failed for live ID %d: %v", liveId, err)
-		}
-		length := resp.ContentLength
-		resp.Body.Close()
-		bar.IncrInt64(1)
-		return length, nil
+		defer server.Close()
+		slog.Info("Serving metrics", "url", "http://"+cfg.Metrics+"/metrics")
+	}
+	slog.Info("Fetching calls")
+	liveIds, _, err := s.fetchCalls()
+	if err != nil {
+		hooks.fail("Error listing calls", err)
 	}
-	sizes, err := concurrentExecute(fetchFunction, liveIds, fetchConcurrency)
+	num := len(liveIds)
+	listed := num
+	report.Listed = listed
+	slog.Info("Found calls, fetching sizes", "count", num)
+	d := &downloader{config: cfg, session: s, library: library, manifest: newManifest(), limiter: limiter, disk: disk, hooks: hooks, report: report, store: store, uploads: uploads}
+	if !d.local() {
+		if len(uploads) > 0 {
+			fatal("Uploads copy calls from the output directory and cannot be combined with -storage")
+		}
+		slog.Info("Uploading calls", "storage", store.String())
+	}
+	sizes, err := d.fetchSizes(liveIds)
 	if err != nil {
-		log.Fatalf("Error during concurrent execution: %v", err)
+		hooks.fail("Error fetching sizes", err)
 	}
-	p.Wait()
-	println("Finished fetching calls.")
 	totalSize := int64(0)
 	for _, size := range sizes {
-		if size <= 0 {
-			log.Fatal("Some calls have invalid sizes, please check the error log for details.")
-		}
 		totalSize += size
 	}
-	if totalSize > (1024 * 1024 * 1024) {
-		fmt.Printf("Total size of all calls: %.2f GiB\n", float64(totalSize)/1024/1024/1024)
-	} else if totalSize > (1024 * 1024) {
-		fmt.Printf("Total size of all calls: %.2f MiB\n", float64(totalSize)/1024/1024)
-	} else {
-		fmt.Printf("Total size of all calls: %.2f KiB\n", float64(totalSize)/1024)
-	}
-	loadedSums := make(map[string]string)
-	if !*disableHash {
-		println("Verifying hash file...")
-		jsonFile, err := os.Open(callHashFilePath)
+	slog.Info("Fetched sizes", "total", formatByteSize(totalSize))
+	loadedSums := d.manifest
+	if !cfg.DisableHash {
+		slog.Info("Verifying hash file")
+		loadedSums, err = openManifest(context.Background(), clients.API, cfg.ManifestSource, cfg.ManifestKey)
 		if err != nil {
-			log.Fatalf("Error opening %s: %v", callHashFilePath, err)
-		}
-		decoder := json.NewDecoder(jsonFile)
-		if err := decoder.Decode(&loadedSums); err != nil {
-			log.Fatalf("Error decoding %s: %v", callHashFilePath, err)
-		}
-		jsonFile.Close()
-		print("Hash file verification: ")
-		if len(loadedSums) != len(liveIds) {
-			color.Red("failed\nHash file does not match fetched calls.")
-			os.Exit(1)
-		}
-		for _, liveId := range liveIds {
-			liveIdStr := strconv.Itoa(liveId)
-			if _, ok := loadedSums[liveIdStr]; !ok {
-				color.Red("failed\nHash file does not match fetched calls.")
-				os.Exit(1)
+			hooks.fail("Error loading hash file", err)
+		}
+		d.manifest = loadedSums
+		drift := loadedSums.drift(liveIds)
+		if len(drift.Unlisted) == 0 && len(drift.Removed) == 0 {
+			slog.Info("Hash file matches the fetched calls")
+		} else {
+			slog.Warn("Hash file does not match the fetched calls", "verified", len(liveIds)-len(drift.Unlisted))
+		}
+		if len(drift.Removed) > 0 {
+			slog.Warn("Hash file entries are no longer listed by Phoning", "count", len(drift.Removed), "liveIds", strings.Join(drift.Removed, ","))
+		}
+		if len(drift.Unlisted) > 0 {
+			unlisted := make([]string, len(drift.Unlisted))
+			for i, liveId := range drift.Unlisted {
+				unlisted[i] = strconv.Itoa(liveId)
+			}
+			if cfg.Unverified == "skip" {
+				slog.Warn("Calls are not in the hash file and will be skipped", "count", len(unlisted), "liveIds", strings.Join(unlisted, ","))
+				liveIds = slices.DeleteFunc(liveIds, func(liveId int) bool {
+					return slices.Contains(drift.Unlisted, liveId)
+				})
+				for _, liveId := range drift.Unlisted {
+					delete(sizes, liveId)
+				}
+				num = len(liveIds)
+			} else {
+				slog.Warn("Calls are not in the hash file and will be downloaded without verification", "count", len(unlisted), "liveIds", strings.Join(unlisted, ","))
 			}
 		}
-		color.Green("success")
 	}
 	skipIds := make([]int, 0)
 	existingIds := make([]int, 0)
-	files, err := os.ReadDir(*outputDir)
+	files, err := store.List(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to read output directory: %v", err)
+		fatal("Failed to list existing files", "storage", store.String(), "err", err)
 	}
 	for _, file := range files {
-		if file.IsDir() {
+		liveId, ok := parseCallFileName(file.Name)
+		if !ok {
 			continue
 		}
-		fileName := file.Name()
-		if len(fileName) < 4 || fileName[len(fileName)-4:] != ".mp4" {
+		size, ok := sizes[liveId]
+		if !ok {
 			continue
 		}
-		liveIdStr := fileName[:len(fileName)-4]
-		liveId, err := strconv.Atoi(liveIdStr)
-		if err != nil {
+		if !d.local() {
+			// uploads are completed only after they match the manifest, so an object of the right size is whole
+			if file.Size == size {
+				existingIds = append(existingIds, liveId)
+			}
 			continue
 		}
-		if _, ok := sizes[liveId]; !ok {
+		if hasCheckpoint(filepath.Join(cfg.OutputDir, file.Name)) {
+			// interrupted download, resumed below
 			continue
 		}
 		existingIds = append(existingIds, liveId)
 	}
-	if !*disableHash {
-		fmt.Printf("Found %d existing files in the output directory. Checking hash matches...\n", len(existingIds))
+	if !cfg.DisableHash && d.local() {
+		slog.Info("Checking hashes of existing files", "count", len(existingIds))
+		p := mpb.New(mpb.WithWidth(64), mpb.PopCompletedMode())
+		restoreLog := logAbove(p)
+		repairOpts := downloadOptions{Chunks: cfg.Chunks, Limiter: limiter, Client: clients.Download}
+		var repaired atomic.Int64
 		cleanupFunc := func (liveId int, ctx context.Context) (bool, error) {
 			liveIdStr := strconv.Itoa(liveId)
-			filePath := filepath.Join(*outputDir, liveIdStr+".mp4")
-			compSum, ok := loadedSums[liveIdStr]
+			filePath := filepath.Join(cfg.OutputDir, liveIdStr+".mp4")
+			entry, ok := loadedSums.Calls[liveIdStr]
 			if !ok {
-				return false, fmt.Errorf("hash for live ID %d not found in %s", liveId, callHashFilePath)
+				// nothing to verify against, keep the file as it is
+				report.hash(hashUnverified)
+				return true, nil
 			}
-			sum, err := checksum(filePath)
-			if err != nil {
-				return false, fmt.Errorf("error calculating hash for live ID %d: %v", liveId, err)
+			if info, err := os.Stat(filePath); err == nil {
+				// unchanged since it was last verified
+				if sums, ok := library.cachedHashes(liveIdStr, info, entry.algorithms()); ok && entry.verify(-1, sums) == nil {
+					report.hash("ok")
+					return true, nil
+				}
 			}
-			if sum != compSum {
-				err = os.Remove(filePath)
+			var record quarantineRecord
+			if entry.canRepair() {
+				// fix corrupted blocks in place rather than downloading the whole file again
+				fetched, err := repairCall(ctx, s, p, liveId, filePath, entry, repairOpts)
+				if err == nil {
+					if fetched > 0 {
+						repaired.Add(1)
+						report.hash(hashRepaired)
+					} else {
+						report.hash("ok")
+					}
+					if err := library.recordFile(filePath, liveIdStr, entry.Hashes); err != nil {
+						return false, err
+					}
+					return true, nil
+				}
+				slog.Warn("Could not repair file", "liveId", liveId, "err", err)
+				record = newQuarantineRecord(liveId, entry, nil, fmt.Errorf("repair failed: %v", err))
+			} else {
+				_, mismatch, err := library.verifyFile(filePath, liveIdStr, entry, true)
 				if err != nil {
-					return false, fmt.Errorf("error removing file for live ID %d: %v", liveId, err)
+					report.hash("error")
+					return false, fmt.Errorf("error calculating hash for live ID %d: %v", liveId, err)
+				}
+				if mismatch == nil {
+					report.hash("ok")
+					return true, nil
 				}
-				log.Printf("Removed file with hash mismatch: live ID %d", liveId)
-				return false, nil
+				record = newQuarantineRecord(liveId, entry, library.recorded(liveIdStr), mismatch)
 			}
-			return true, nil
+			// keep the file around in case the manifest is the one that is wrong
+			dest, err := quarantineFile(cfg.OutputDir, record)
+			if err != nil {
+				return false, fmt.Errorf("error quarantining file for live ID %d: %v", liveId, err)
+			}
+			library.forget(liveIdStr)
+			slog.Warn("Quarantined file with hash mismatch", "liveId", liveId, "dest", dest)
+			report.hash("mismatch")
+			hooks.fire(hookEvent{Event: eventHashMismatch, LiveId: liveId, File: filePath, Error: record.Reason})
+			return false, nil
+		}
+		checkedIdsMap, err := runPool(context.Background(), cleanupFunc, existingIds, cfg.Concurrency, nil)
+		p.Wait()
+		restoreLog()
+		if err := library.save(); err != nil {
+			slog.Warn("Could not save library index", "err", err)
 		}
-		checkedIdsMap, err := concurrentExecute(cleanupFunc, existingIds, *concurrency)
 		if err != nil {
-			println(err)
-			os.Exit(1)
+			hooks.fail("Error checking existing files", err)
 		}
 		for liveId, ok := range checkedIdsMap {
 			if ok {
 				skipIds = append(skipIds, liveId)
 			}
 		}
-		println("Removed", len(existingIds) - len(skipIds), "files with mismatching hashes, found", len(skipIds), "existing files with matching hashes. Skipping them.")
+		report.Repaired = int(repaired.Load())
+		report.Quarantined = len(existingIds) - len(skipIds)
+		if repaired.Load() > 0 {
+			slog.Info("Repaired files with corrupted blocks", "count", repaired.Load())
+		}
+		slog.Info("Checked existing files, skipping the matching ones", "matching", len(skipIds), "quarantined", len(existingIds)-len(skipIds))
 	} else {
 		skipIds = existingIds
-		fmt.Printf("Found %d existing files in the output directory. Skipping them.\n", len(skipIds))
+		slog.Info("Skipping existing files", "count", len(skipIds))
+	}
+	if d.local() {
+		for liveId := range sizes {
+			// deleted locally once uploaded, the copies on the upload targets are kept
+			if library.deleted(strconv.Itoa(liveId)) && !slices.Contains(skipIds, liveId) {
+				skipIds = append(skipIds, liveId)
+			}
+		}
 	}
 	newLiveIds := make([]int, 0, num-len(skipIds))
 	for _, liveId := range liveIds {
@@ -314,130 +323,100 @@ func main() {
 		}
 	}
 	liveIds = newLiveIds
+	report.Skipped = len(skipIds) - report.Repaired
 	num = len(liveIds)
 	totalSize = 0
 	for id, size := range sizes {
-		if size <= 0 {
-			log.Fatal("Some calls have invalid sizes, please check the error log for details.")
-		}
 		if slices.Contains(skipIds, id) {
 			continue
 		}
 		totalSize += size
 	}
-	available, err := getDiskFreeSpace(*outputDir)
-	if err != nil {
-		log.Fatalf("%v", err)
+	var available int64 = math.MaxInt64 // nothing to check for object storage
+	if d.local() {
+		available, err = getDiskFreeSpace(cfg.OutputDir)
+		if err != nil {
+			fatal("Error checking free disk space", "err", err)
+		}
 	}
 	showIgnoreWarning := false
-	if available < totalSize {
+	if available-disk.minFree < totalSize {
+		slog.Warn("Not enough disk space, downloads that do not fit wait until space is freed", "dir", cfg.OutputDir,
+			"need", formatByteSize(totalSize), "available", formatByteSize(max(available-disk.minFree, 0)), "minFree", formatByteSize(disk.minFree))
 		showIgnoreWarning = true
 	}
+	// the question is asked on the terminal, not logged
 	for showIgnoreWarning {
-		fmt.Printf("Warning: Not enough disk space in %s: need %d bytes, available %d bytes\n", *outputDir, totalSize, available)
-		print("Do you want to ignore this warning and proceed? (y/n): ")
+		fmt.Print("Do you want to ignore this warning and proceed? (y/n): ")
 		var response string
 		fmt.Scanln(&response)
 		switch response {
 			case "y", "Y":
-				fmt.Println("Proceeding with the download...")
+				slog.Info("Proceeding with the download")
 				showIgnoreWarning = false
 			case "n", "N":
-				fmt.Println("Exiting...")
+				slog.Info("Exiting")
 				os.Exit(0)
 			default:
 				fmt.Println("Invalid input. Please enter 'y' or 'n'.")
 				continue
 		}
 	}
-	println("Downloading...")
-	p = mpb.New(mpb.WithWidth(64), mpb.PopCompletedMode())
-	totalbar := p.New(totalSize,
-		mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
-		mpb.BarPriority(1000),
-		mpb.PrependDecorators(
-			decor.Name("", decor.WC{W: 5, C: decor.DindentRight}),
-			decor.Current(decor.SizeB1024(0), "% .1f", decor.WC{W: 11}),
-			decor.TotalKibiByte(" / % .1f", decor.WC{W: 14, C: decor.DindentRight}),
-			decor.AverageSpeed(decor.SizeB1024(0), "% .1f", decor.WC{W: 13}),
-			decor.Elapsed(decor.ET_STYLE_MMSS, decor.WC{W: 10}),
-			decor.Name(" ETA: ", decor.WC{W: 6}),
-			decor.AverageETA(decor.ET_STYLE_MMSS, decor.WC{W: 9, C: decor.DindentRight}),
-		),
-		mpb.AppendDecorators(
-			decor.NewPercentage("%.2f", decor.WC{W: 7}),
-		),
-	)
-	countbar := p.New(int64(num),
-		mpb.BarStyle().Padding(" ").Lbound(" ").Filler(" ").Tip(" ").Lbound(" ").Rbound(" "),
-		mpb.BarPriority(999),
-		mpb.PrependDecorators(
-			decor.Name(color.CyanString("Total"), decor.WC{W: 5, C: decor.DindentRight}),
-			decor.Current(0, "(%d", decor.WC{W: 5}),
-			decor.Total(0, "/%d)", decor.WC{W: 5, C: decor.DindentRight}),
-		),
-	)
-	downloadFunction := func(liveId int, ctx context.Context) (bool, error) {
-		liveIdStr := strconv.Itoa(liveId)
-		compSum, ok := loadedSums[liveIdStr]
-		if !*disableHash && !ok {
-			return false, fmt.Errorf("hash for live ID %d not found in %s", liveId, callHashFilePath)
-		}
-		pnxml, err := getPNXML(api_key, access_token, liveId)
+	if cfg.LimitControl != "" {
+		server, err := serveRateControl(cfg.LimitControl, limiter)
 		if err != nil {
-			log.Fatalf("Error getting PNXML for live ID %d: %v", liveId, err)
+			fatal(err.Error())
 		}
-		url, ok := pnxml["url"].(string)
-		if !ok {
-			log.Fatalf("PNXML for live ID %d does not contain a valid URL", liveId)
-		}
-		downloadFilePath := filepath.Join(*outputDir, liveIdStr+".mp4")
-		bar := p.New(sizes[liveId],
-			mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
-			mpb.PrependDecorators(
-				decor.Name(liveIdStr, decor.WC{W: 5, C: decor.DindentRight}),
-				decor.Current(decor.SizeB1024(0), "% .1f", decor.WC{W: 11}),
-				decor.TotalKibiByte(" / % .1f", decor.WC{W: 14, C: decor.DindentRight}),
-				decor.AverageSpeed(decor.SizeB1024(0), "% .1f", decor.WC{W: 13}),
-				decor.Elapsed(decor.ET_STYLE_MMSS, decor.WC{W: 10}),
-				decor.OnComplete(
-					decor.Name(" ETA: "),
-					color.GreenString(" Done"),
-				),
-				decor.OnComplete(
-					decor.AverageETA(decor.ET_STYLE_MMSS, decor.WC{W: 9, C: decor.DindentRight}),
-					"",
-				),
-			),
-			mpb.BarFillerOnComplete(""),
-			mpb.AppendDecorators(
-				decor.OnComplete(
-					decor.NewPercentage("%.2f", decor.WC{W: 7}),
-					"",
-				),
-			),
-		)
-		hookTotalProgress(bar, totalbar)
-		err = DownloadVideo(ctx, url, downloadFilePath, *outputDir, *chunk, bar)
-		if err != nil {
-			return false, fmt.Errorf("error downloading live ID %d: %v", liveId, err)
+		defer server.Close()
+		slog.Info("Bandwidth limit can be changed", "url", "http://"+cfg.LimitControl+"/limit")
+	}
+	if cfg.Adaptive {
+		d.controller = newAdaptiveController(cfg.Concurrency, cfg.Chunks)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go d.controller.Run(ctx)
+	}
+	ctx := context.Background()
+	if deadline := sched.deadline(started); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadlineCause(ctx, deadline, errPaused)
+		defer cancel()
+		slog.Info("Downloads will pause", "at", deadline.Format(time.DateTime))
+	}
+	slog.Info("Downloading", "calls", num, "order", cfg.Order)
+	d.startUploads(ctx)
+	downloaded, err := d.downloadCalls(ctx, liveIds, sizes)
+	d.waitUploads()
+	if err == nil && len(uploads) > 0 {
+		// existing files, and those whose upload failed in an earlier run
+		d.uploadPending(ctx, skipIds)
+	}
+	paused := errors.Is(err, errPaused)
+	report.Paused = paused
+	if paused {
+		report.finish(nil)
+	} else {
+		report.finish(err)
+	}
+	fmt.Println()
+	report.print(os.Stdout)
+	if len(formats) > 0 {
+		paths, writeErr := report.write(cfg.OutputDir, formats)
+		if writeErr != nil {
+			slog.Warn("Could not write report", "err", writeErr)
 		}
-		if !*disableHash {
-			sum, err := checksum(downloadFilePath)
-			if err != nil {
-				return false, fmt.Errorf("error calculating hash for live ID %d: %v", liveId, err)
-			}
-			if sum != compSum {
-				return false, fmt.Errorf("hash mismatch for live ID %d: expected %s, got %s", liveId, compSum, sum)
-			}
+		for _, path := range paths {
+			slog.Info("Wrote report", "file", path)
 		}
-		countbar.IncrInt64(1)
-		return true, nil
 	}
-	_, err = concurrentExecute(downloadFunction, liveIds, *concurrency)
-	if err != nil {
-		log.Fatalf("Error during concurrent execution: %v", err)
+	if err != nil && !paused {
+		hooks.fail("Error downloading calls", err)
+	}
+	hooks.fire(hookEvent{Event: eventRunSummary, Listed: listed, Downloaded: downloaded, Duration: time.Since(started).Round(time.Second).String(), Paused: paused})
+	if paused {
+		slog.Info("Paused, run again to resume", "downloaded", downloaded, "calls", num)
+	} else {
+		slog.Info("Finished downloading", "calls", num)
 	}
-	p.Wait()
-	fmt.Printf("Finished downloading %d calls.\n", num)
-}
\ No newline at end of file
+	hooks.wait()
+}
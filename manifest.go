@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const manifestVersion = 2
+
+// embeddedManifest is the hash/sum.json the binary was built with. It is used
+// unless another manifest is given with -manifest.
+//
+//go:embed hash/sum.json
+var embeddedManifest []byte
+
+// manifest maps live IDs to what the downloaded file is expected to look like.
+//
+// Version 1 is the original hash/sum.json, a flat object of live ID to the
+// base32 SHA-1 of the file. It is still accepted and loaded as sha1 hashes.
+type manifest struct {
+	Version int                      `json:"version"`
+	Calls   map[string]manifestEntry `json:"calls"`
+}
+
+type manifestEntry struct {
+	Size           int64             `json:"size,omitempty"`
+	Hashes         map[string]string `json:"hashes"` // algorithm name -> encoded digest
+	Representation string            `json:"representation,omitempty"`
+	Quality        string            `json:"quality,omitempty"`
+	BlockSize      int64             `json:"blockSize,omitempty"`
+	Blocks         []string          `json:"blocks,omitempty"` // sha256 of each BlockSize block
+}
+
+func newManifest() *manifest {
+	return &manifest{Version: manifestVersion, Calls: make(map[string]manifestEntry)}
+}
+
+// parseManifest decodes either manifest format.
+func parseManifest(data []byte) (*manifest, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	if _, ok := probe["version"]; !ok {
+		var legacy map[string]string
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("legacy manifest: %w", err)
+		}
+		m := newManifest()
+		m.Version = 1
+		for liveId, sum := range legacy {
+			m.Calls[liveId] = manifestEntry{Hashes: map[string]string{"sha1": sum}}
+		}
+		return m, nil
+	}
+	m := newManifest()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest version %d is newer than supported version %d", m.Version, manifestVersion)
+	}
+	for liveId, entry := range m.Calls {
+		if len(entry.algorithms()) == 0 {
+			return nil, fmt.Errorf("entry %s has no supported hash", liveId)
+		}
+	}
+	return m, nil
+}
+
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// hashFile builds a manifest entry for a local file in a single pass.
+// A blockSize of 0 leaves out the block hashes.
+func hashFile(path string, algorithms []string, blockSize int64) (manifestEntry, error) {
+	set, err := newHashSet(algorithms...)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer file.Close()
+
+	var w io.Writer = set
+	var blocks *blockHasher
+	if blockSize > 0 {
+		blocks = newBlockHasher(blockSize)
+		w = io.MultiWriter(set, blocks)
+	}
+	size, err := io.CopyBuffer(w, file, make([]byte, 64*1024))
+	if err != nil {
+		return manifestEntry{}, fmt.Errorf("failed to hash: %v", err)
+	}
+	entry := manifestEntry{Size: size, Hashes: set.Sums()}
+	if blocks != nil {
+		entry.BlockSize = blockSize
+		entry.Blocks = blocks.Blocks()
+	}
+	return entry, nil
+}
+
+// save writes the manifest to path, replacing it atomically.
+func (m *manifest) save(path string) error {
+	data, err := m.encode()
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// encode returns the manifest as indented JSON in the current format.
+func (m *manifest) encode() ([]byte, error) {
+	m.Version = manifestVersion
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// algorithms returns the supported algorithms this entry has a hash for, sorted.
+func (e manifestEntry) algorithms() []string {
+	var names []string
+	for name := range e.Hashes {
+		if _, ok := hashAlgorithms[name]; ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// verify compares a file's size and hashes with the entry. A size of -1 skips the size check.
+// Every hash the entry knows has to match.
+func (e manifestEntry) verify(size int64, sums map[string]string) error {
+	if e.Size > 0 && size >= 0 && e.Size != size {
+		return fmt.Errorf("size mismatch: expected %d, got %d", e.Size, size)
+	}
+	var mismatches []string
+	for _, name := range e.algorithms() {
+		got, ok := sums[name]
+		if !ok {
+			return fmt.Errorf("%s was not computed", name)
+		}
+		if got != e.Hashes[name] {
+			mismatches = append(mismatches, fmt.Sprintf("%s expected %s, got %s", name, e.Hashes[name], got))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("hash mismatch: %s", strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// manifestDrift is the difference between a manifest and the calls listed by Phoning.
+type manifestDrift struct {
+	Unlisted []int    // listed calls the manifest has no entry for
+	Removed  []string // manifest entries for calls that are no longer listed
+}
+
+func (m *manifest) drift(liveIds []int) manifestDrift {
+	var drift manifestDrift
+	listed := make(map[string]bool, len(liveIds))
+	for _, liveId := range liveIds {
+		liveIdStr := strconv.Itoa(liveId)
+		listed[liveIdStr] = true
+		if _, ok := m.Calls[liveIdStr]; !ok {
+			drift.Unlisted = append(drift.Unlisted, liveId)
+		}
+	}
+	for _, liveIdStr := range m.liveIds() {
+		if !listed[liveIdStr] {
+			drift.Removed = append(drift.Removed, liveIdStr)
+		}
+	}
+	slices.Sort(drift.Unlisted)
+	return drift
+}
+
+// liveIds returns the manifest keys in sorted order.
+func (m *manifest) liveIds() []string {
+	return slices.Sorted(maps.Keys(m.Calls))
+}
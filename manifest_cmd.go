@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+const manifestUsage = `Usage:
+  phoning-downloader manifest build [flags] <directory>
+  phoning-downloader manifest diff <old.json> <new.json>
+  phoning-downloader manifest show [-manifest <path or URL>] [-manifest-key <key>]
+  phoning-downloader manifest keygen <private key file>
+  phoning-downloader manifest sign <private key file> <manifest.json>`
+
+// manifestCommand runs a manifest subcommand. Results, such as the lines of a
+// diff or a public key, are plain command output on stdout; progress and errors
+// are logged.
+func manifestCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, manifestUsage)
+		os.Exit(2)
+	}
+	// diff, keygen and sign have no flags and log with the defaults
+	if _, err := setupLogging(logConfig{Level: "info", Format: "text"}); err != nil {
+		log.Fatal(err)
+	}
+	switch args[0] {
+	case "build":
+		manifestBuild(args[1:])
+	case "diff":
+		manifestDiff(args[1:])
+	case "show":
+		manifestShow(args[1:])
+	case "keygen":
+		manifestKeygen(args[1:])
+	case "sign":
+		manifestSign(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, manifestUsage)
+		os.Exit(2)
+	}
+}
+
+// manifestBuild hashes every call file below a directory and writes or merges a manifest.
+func manifestBuild(args []string) {
+	flags := flag.NewFlagSet("manifest build", flag.ExitOnError)
+	output := flags.String("o", filepath.Join("hash", "sum.json"), "Manifest file to write")
+	merge := flags.Bool("merge", true, "Keep entries of the existing manifest that were not found in the directory")
+	concurrency := flags.Int("c", 4, "Files hashed in parallel")
+	algorithms := flags.String("algorithms", "sha1,sha256", "Comma separated hash algorithms to record")
+	blockSizeStr := flags.String("block-size", "8M", "Size of blocks for per-block hashes (0 to leave them out)")
+	logging := addLogFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, manifestUsage)
+		os.Exit(2)
+	}
+	closeLog, err := setupLogging(logging())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	if *concurrency < 1 {
+		fatal("Concurrency must be at least 1")
+	}
+	algs := strings.Split(*algorithms, ",")
+	if _, err := newHashSet(algs...); err != nil {
+		fatal("Invalid -algorithms", "err", err)
+	}
+	blockSize, err := parseByteSize(*blockSizeStr)
+	if err != nil {
+		fatal("Invalid -block-size", "err", err)
+	}
+	dir := flags.Arg(0)
+
+	m := newManifest()
+	if *merge {
+		existing, err := loadManifest(*output)
+		switch {
+		case err == nil:
+			m = existing
+		case errors.Is(err, os.ErrNotExist):
+		default:
+			fatal("Error loading manifest", "file", *output, "err", err)
+		}
+	}
+
+	paths := make(map[string]string) // live ID -> file
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		liveId, ok := parseCallFileName(d.Name())
+		if !ok {
+			return nil
+		}
+		liveIdStr := strconv.Itoa(liveId)
+		if other, ok := paths[liveIdStr]; ok {
+			return fmt.Errorf("live ID %d found twice: %s and %s", liveId, other, path)
+		}
+		paths[liveIdStr] = path
+		return nil
+	})
+	if err != nil {
+		fatal("Error reading directory", "dir", dir, "err", err)
+	}
+	liveIds := slices.Sorted(maps.Keys(paths))
+	slog.Info("Hashing call files", "files", len(liveIds), "dir", dir)
+
+	p := mpb.New(mpb.WithWidth(64))
+	bar := p.New(int64(len(liveIds)),
+		mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
+		mpb.PrependDecorators(
+			decor.Name("Hashing...", decor.WC{W: 5, C: decor.DindentRight}),
+			decor.Current(0, "(%d", decor.WC{W: 5}),
+			decor.Total(0, "/%d)", decor.WC{W: 5, C: decor.DindentRight}),
+		),
+		mpb.AppendDecorators(
+			decor.NewPercentage("%.2f", decor.WC{W: 7}),
+		),
+	)
+	hashFunction := func(liveIdStr string, ctx context.Context) (manifestEntry, error) {
+		entry, err := hashFile(paths[liveIdStr], algs, blockSize)
+		if err != nil {
+			return entry, fmt.Errorf("hashing %s: %w", paths[liveIdStr], err)
+		}
+		bar.IncrInt64(1)
+		return entry, nil
+	}
+	entries, err := runPool(context.Background(), hashFunction, liveIds, *concurrency, nil)
+	if err != nil {
+		bar.Abort(false)
+		p.Wait()
+		fatal("Error during concurrent execution", "err", err)
+	}
+	p.Wait()
+
+	added, updated := 0, 0
+	for liveIdStr, entry := range entries {
+		old, ok := m.Calls[liveIdStr]
+		if !ok {
+			added++
+		} else {
+			if compareEntries(old, entry) != "" {
+				updated++
+			}
+			entry.Representation = old.Representation
+			entry.Quality = old.Quality
+		}
+		m.Calls[liveIdStr] = entry
+	}
+	if err := m.save(*output); err != nil {
+		fatal("Error writing manifest", "file", *output, "err", err)
+	}
+	fmt.Printf("Wrote %s: %d entries, %d new, %d changed.\n", *output, len(m.Calls), added, updated)
+}
+
+// manifestDiff lists entries that are new, changed or missing in the second manifest.
+// Like diff(1) it exits with status 1 when the manifests differ.
+func manifestDiff(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, manifestUsage)
+		os.Exit(2)
+	}
+	oldManifest, err := loadManifest(args[0])
+	if err != nil {
+		fatal("Error loading manifest", "file", args[0], "err", err)
+	}
+	newManifest, err := loadManifest(args[1])
+	if err != nil {
+		fatal("Error loading manifest", "file", args[1], "err", err)
+	}
+	var added, changed, missing []string
+	for _, liveIdStr := range newManifest.liveIds() {
+		old, ok := oldManifest.Calls[liveIdStr]
+		if !ok {
+			added = append(added, liveIdStr)
+			continue
+		}
+		if reason := compareEntries(old, newManifest.Calls[liveIdStr]); reason != "" {
+			changed = append(changed, fmt.Sprintf("%s (%s)", liveIdStr, reason))
+		}
+	}
+	for _, liveIdStr := range oldManifest.liveIds() {
+		if _, ok := newManifest.Calls[liveIdStr]; !ok {
+			missing = append(missing, liveIdStr)
+		}
+	}
+	for _, liveIdStr := range added {
+		fmt.Println("+", liveIdStr)
+	}
+	for _, line := range changed {
+		fmt.Println("~", line)
+	}
+	for _, liveIdStr := range missing {
+		fmt.Println("-", liveIdStr)
+	}
+	fmt.Printf("%d new, %d changed, %d missing\n", len(added), len(changed), len(missing))
+	if len(added)+len(changed)+len(missing) > 0 {
+		os.Exit(1)
+	}
+}
+
+// compareEntries describes how two entries for the same call differ, or returns
+// "" if they agree. Only sizes and algorithms present in both are compared.
+func compareEntries(a, b manifestEntry) string {
+	if a.Size > 0 && b.Size > 0 && a.Size != b.Size {
+		return fmt.Sprintf("size %d -> %d", a.Size, b.Size)
+	}
+	for _, name := range a.algorithms() {
+		if sum, ok := b.Hashes[name]; ok && sum != a.Hashes[name] {
+			return name + " differs"
+		}
+	}
+	return ""
+}
+
+// manifestShow prints which manifest is in effect and how many entries it has.
+func manifestShow(args []string) {
+	flags := flag.NewFlagSet("manifest show", flag.ExitOnError)
+	source := flags.String("manifest", "", "Hash file path or HTTPS URL (default is the hash file built into the binary)")
+	key := flags.String("manifest-key", manifestPublicKey, "Base64 ed25519 public key for remote hash files")
+	transport := addTransportFlags(flags)
+	logging := addLogFlags(flags)
+	flags.Parse(args)
+	closeLog, err := setupLogging(logging())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	clients, err := newHTTPClients(transport())
+	if err != nil {
+		fatal("Invalid connection settings", "err", err)
+	}
+	m, err := openManifest(context.Background(), clients.API, *source, *key)
+	if err != nil {
+		fatal("Error loading hash file", "err", err)
+	}
+	switch {
+	case *source == "":
+		fmt.Println("Source: built-in")
+	case strings.HasPrefix(*source, "https://"):
+		fmt.Printf("Source: %s (signature verified)\n", *source)
+	default:
+		abs, err := filepath.Abs(*source)
+		if err != nil {
+			abs = *source
+		}
+		fmt.Printf("Source: %s\n", abs)
+	}
+	fmt.Printf("Version: %d\n", m.Version)
+	fmt.Printf("Entries: %d\n", len(m.Calls))
+}
+
+// manifestKeygen writes a new ed25519 private key and prints the public key
+// to pass as -manifest-key.
+func manifestKeygen(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, manifestUsage)
+		os.Exit(2)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		fatal("Error generating key", "err", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(privateKey.Seed())
+	if err := os.WriteFile(args[0], []byte(encoded+"\n"), 0600); err != nil {
+		fatal("Error writing key", "err", err)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(publicKey))
+}
+
+// manifestSign writes the detached signature of a manifest next to it as <manifest>.sig.
+func manifestSign(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, manifestUsage)
+		os.Exit(2)
+	}
+	seedData, err := os.ReadFile(args[0])
+	if err != nil {
+		fatal("Error reading key", "err", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(seedData)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		fatal("Not a key written by manifest keygen", "file", args[0])
+	}
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		fatal("Error reading manifest", "err", err)
+	}
+	if _, err := parseManifest(data); err != nil {
+		fatal("Error decoding manifest", "file", args[1], "err", err)
+	}
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(seed), data)
+	if err := os.WriteFile(args[1]+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644); err != nil {
+		fatal("Error writing signature", "err", err)
+	}
+	fmt.Printf("Wrote %s.sig\n", args[1])
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxManifestSize = 16 * 1024 * 1024
+
+// manifestPublicKey is the base64 ed25519 key remote manifests have to be signed with.
+// Release builds pin the project key with -ldflags "-X main.manifestPublicKey=<key>"
+// (see goreleaser.yml); -manifest-key overrides it. Without a key, remote
+// manifests are refused rather than used unverified.
+var manifestPublicKey = ""
+
+// openManifest loads a manifest from a file path or an HTTPS URL. An empty
+// source means the manifest embedded in the binary.
+func openManifest(ctx context.Context, client *http.Client, source, publicKey string) (*manifest, error) {
+	switch {
+	case source == "":
+		return parseManifest(embeddedManifest)
+	case strings.HasPrefix(source, "https://"):
+		return fetchRemoteManifest(ctx, client, source, publicKey)
+	case strings.HasPrefix(source, "http://"):
+		return nil, fmt.Errorf("remote manifests must use https: %s", source)
+	default:
+		return loadManifest(source)
+	}
+}
+
+func parsePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	if publicKey == "" {
+		return nil, errors.New("no public key to verify remote manifests with: this binary was built without one, pass -manifest-key")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("manifest public key must be a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// decodeSignature accepts a raw 64 byte signature or its base64 encoding.
+func decodeSignature(data []byte) ([]byte, error) {
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("invalid manifest signature format")
+	}
+	return sig, nil
+}
+
+// manifestCache keeps the last verified copy of a remote manifest, its detached
+// signature and ETag in the user cache directory.
+type manifestCache struct {
+	base string // path without extension
+}
+
+func newManifestCache(url string) (*manifestCache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "phoning-downloader", "manifests")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(url))
+	return &manifestCache{base: filepath.Join(dir, hex.EncodeToString(sum[:8]))}, nil
+}
+
+func (c *manifestCache) load() (data, sig []byte, etag string, err error) {
+	if data, err = os.ReadFile(c.base + ".json"); err != nil {
+		return nil, nil, "", err
+	}
+	if sig, err = os.ReadFile(c.base + ".json.sig"); err != nil {
+		return nil, nil, "", err
+	}
+	etagBytes, _ := os.ReadFile(c.base + ".etag")
+	return data, sig, string(etagBytes), nil
+}
+
+func (c *manifestCache) store(data, sig []byte, etag string) error {
+	if err := os.WriteFile(c.base+".json", data, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.base+".json.sig", sig, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(c.base+".etag", []byte(etag), 0644)
+}
+
+func fetchBytes(ctx context.Context, client *http.Client, url string, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return resp, nil, err
+	}
+	if len(data) > maxManifestSize {
+		return resp, nil, fmt.Errorf("%s is larger than %d bytes", url, maxManifestSize)
+	}
+	return resp, data, nil
+}
+
+// fetchRemoteManifest downloads a manifest and its detached signature (url + ".sig"),
+// revalidating the cached copy with its ETag. Nothing is used before the signature
+// has been verified against publicKey. If the server cannot be reached, the last
+// verified copy is used.
+func fetchRemoteManifest(ctx context.Context, client *http.Client, url, publicKey string) (*manifest, error) {
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newManifestCache(url)
+	if err != nil {
+		return nil, fmt.Errorf("manifest cache: %w", err)
+	}
+	cachedData, cachedSig, etag, cacheErr := cache.load()
+
+	header := http.Header{}
+	if cacheErr == nil && etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	resp, data, err := fetchBytes(ctx, client, url, header)
+	if err != nil {
+		if cacheErr != nil {
+			return nil, fmt.Errorf("fetching manifest: %w", err)
+		}
+		slog.Warn("Could not fetch manifest, using cached copy", "url", url, "err", err)
+		return verifyManifest(cachedData, cachedSig, key)
+	}
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if cacheErr != nil {
+			return nil, fmt.Errorf("fetching manifest: got 304 without a cached copy")
+		}
+		return verifyManifest(cachedData, cachedSig, key)
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("fetching manifest: %s", resp.Status)
+	}
+
+	sigResp, sigData, err := fetchBytes(ctx, client, url+".sig", nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest signature: %w", err)
+	}
+	if sigResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching manifest signature: %s", sigResp.Status)
+	}
+	m, err := verifyManifest(data, sigData, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.store(data, sigData, resp.Header.Get("ETag")); err != nil {
+		slog.Warn("Could not cache manifest", "err", err)
+	}
+	return m, nil
+}
+
+func verifyManifest(data, sigData []byte, key ed25519.PublicKey) (*manifest, error) {
+	sig, err := decodeSignature(sigData)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, data, sig) {
+		return nil, errors.New("manifest signature verification failed")
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRemoteManifestNeedsKey(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"version": 1, "calls": {}}`))
+	}))
+	defer server.Close()
+	_, err := openManifest(context.Background(), server.Client(), server.URL+"/sum.json", "")
+	if err == nil || !strings.Contains(err.Error(), "-manifest-key") {
+		t.Errorf("err = %v, want a missing key error", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("%d requests sent without a key", n)
+	}
+}
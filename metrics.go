@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// stats holds the metrics of this process, served in the Prometheus text format
+// with -metrics.
+var stats = newMetrics()
+
+// apiLatencyBuckets are the upper bounds in seconds of the API latency histogram.
+var apiLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metrics struct {
+	downloadedBytes  atomic.Int64
+	activeDownloads  atomic.Int64
+	activeChunks     atomic.Int64
+	diskWaiting      atomic.Int64
+	retries          counterVec // by reason
+	responses        counterVec // by source and status code
+	hashVerification counterVec // by result
+	apiLatency       histogramVec
+
+	mu      sync.Mutex
+	diskDir string // free space is reported for this directory
+}
+
+func newMetrics() *metrics {
+	return &metrics{apiLatency: histogramVec{buckets: apiLatencyBuckets}}
+}
+
+// counterVec is a set of counters told apart by label values.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]int64 // by label values joined with \x00
+}
+
+func (c *counterVec) inc(labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]int64)
+	}
+	c.values[strings.Join(labels, "\x00")]++
+}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+// histogramVec is a set of histograms told apart by one label value.
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func (h *histogramVec) observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]*histogram)
+	}
+	hist, ok := h.values[label]
+	if !ok {
+		hist = &histogram{counts: make([]int64, len(h.buckets))}
+		h.values[label] = hist
+	}
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// watchDisk makes the metrics report the free space of dir.
+func (m *metrics) watchDisk(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diskDir = dir
+}
+
+// observeResponse counts a response status code from source ("api" or "download").
+func (m *metrics) observeResponse(source string, code int) {
+	m.responses.inc(source, strconv.Itoa(code))
+}
+
+// observeAPI records the latency of an API request to u.
+func (m *metrics) observeAPI(u *url.URL, d time.Duration) {
+	m.apiLatency.observe(apiEndpoint(u), d.Seconds())
+}
+
+// observeVerification counts the outcome of checking a file against the
+// manifest: err if it could not be read, mismatch if it differs.
+func (m *metrics) observeVerification(mismatch, err error) {
+	switch {
+	case err != nil:
+		m.hashVerification.inc("error")
+	case mismatch != nil:
+		m.hashVerification.inc("mismatch")
+	default:
+		m.hashVerification.inc("ok")
+	}
+}
+
+// observeRetry counts a failed attempt that is about to be retried.
+func (m *metrics) observeRetry(err error) {
+	m.retries.inc(retryReason(err))
+}
+
+// apiEndpoint is the host and path of u with numeric path segments such as
+// live IDs replaced, so that every endpoint has one time series.
+func apiEndpoint(u *url.URL) string {
+	segments := strings.Split(u.Path, "/")
+	for i, s := range segments {
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return u.Host + strings.Join(segments, "/")
+}
+
+func retryReason(err error) string {
+	var se *statusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &se):
+		return "http_" + strconv.Itoa(se.Code)
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "short_body"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// write writes all metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	writeMetric(w, "phoning_downloaded_bytes_total", "counter", "Bytes of call videos written to disk.", m.downloadedBytes.Load())
+	writeMetric(w, "phoning_active_downloads", "gauge", "Calls being downloaded.", m.activeDownloads.Load())
+	writeMetric(w, "phoning_active_chunks", "gauge", "Range requests being downloaded.", m.activeChunks.Load())
+	writeMetric(w, "phoning_disk_waiting_downloads", "gauge", "Downloads waiting for disk space.", m.diskWaiting.Load())
+	writeCounterVec(w, "phoning_retries_total", "Failed attempts that were retried, by reason.", &m.retries, "reason")
+	writeCounterVec(w, "phoning_http_responses_total", "HTTP responses, by source and status code.", &m.responses, "source", "code")
+	writeCounterVec(w, "phoning_hash_verifications_total", "Files checked against the manifest, by result.", &m.hashVerification, "result")
+	m.writeAPILatency(w)
+	m.mu.Lock()
+	dir := m.diskDir
+	m.mu.Unlock()
+	if dir != "" {
+		if free, err := getDiskFreeSpace(dir); err == nil {
+			writeMetric(w, "phoning_disk_free_bytes", "gauge", "Free space in the output directory.", free)
+		}
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+func writeCounterVec(w io.Writer, name, help string, c *counterVec, labelNames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, key := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, formatLabels(labelNames, strings.Split(key, "\x00")), c.values[key])
+	}
+}
+
+func (m *metrics) writeAPILatency(w io.Writer) {
+	const name = "phoning_api_request_duration_seconds"
+	h := &m.apiLatency
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s Latency of Phoning API requests, by endpoint.\n# TYPE %s histogram\n", name, name)
+	for _, endpoint := range slices.Sorted(maps.Keys(h.values)) {
+		hist := h.values[endpoint]
+		labels := formatLabels([]string{"endpoint"}, []string{endpoint})
+		var cumulative int64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, hist.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// handleMetrics registers GET /metrics on mux.
+func handleMetrics(mux *http.ServeMux) {
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		stats.write(w)
+	})
+}
+
+// serveMetrics serves the metrics at http://addr/metrics in the background.
+func serveMetrics(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	handleMetrics(mux)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(listener)
+	return server, nil
+}
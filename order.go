@@ -0,0 +1,26 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+var downloadOrders = []string{"newest", "oldest", "smallest", "largest"}
+
+// callOrder returns a comparison of live IDs that sorts calls in the given order.
+// The /lives listing carries no time besides the live ID, which grows with time,
+// so newest and oldest go by live ID.
+func callOrder(order string, sizes map[int]int64) (func(a, b int) int, error) {
+	switch order {
+	case "newest":
+		return func(a, b int) int { return cmp.Compare(b, a) }, nil
+	case "oldest":
+		return cmp.Compare[int], nil
+	case "smallest":
+		return func(a, b int) int { return cmp.Or(cmp.Compare(sizes[a], sizes[b]), cmp.Compare(a, b)) }, nil
+	case "largest":
+		return func(a, b int) int { return cmp.Or(cmp.Compare(sizes[b], sizes[a]), cmp.Compare(a, b)) }, nil
+	}
+	return nil, fmt.Errorf("unknown order %q, must be one of %s", order, strings.Join(downloadOrders, ", "))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 )
 
@@ -24,7 +25,7 @@ func getAPIHeaders(accessToken string) map[string]string {
 	return header
 }
 
-func phoning(method, apiKey, accessToken, endpoint string, params ...map[string]string) (map[string]any, error) {
+func phoning(client *http.Client, method, apiKey, accessToken, endpoint string, params ...map[string]string) (map[string]any, error) {
 	var paramMap map[string]string
 	if len(params) > 0 && params[0] != nil && method == "GET" {
 		paramMap = params[0]
@@ -53,7 +54,7 @@ func phoning(method, apiKey, accessToken, endpoint string, params ...map[string]
 	if method == "POST" || method == "PUT" {
 		body, _ = json.Marshal(params[0])
 	}
-	respBody, err := CallAPI(method, queryUrl, body, getAPIHeaders(accessToken))
+	respBody, err := CallAPI(client, method, queryUrl, body, getAPIHeaders(accessToken))
 	if err != nil {
 		return nil, err
 	}
@@ -3,15 +3,16 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 )
 
-func getPNXML(apiKey, accessToken string, id int) (map[string]any, error) {
+func getPNXML(client *http.Client, apiKey, accessToken string, id int) (map[string]any, error) {
 	endpoint := "/fan/v1.0/lives/" + strconv.Itoa(id) + "/play-info-v3"
 	params := map[string]string{
 		"countryCode": "KR",
 	}
-	res, err := phoning("GET", apiKey, accessToken, endpoint, params)
+	res, err := phoning(client, "GET", apiKey, accessToken, endpoint, params)
 	if err != nil {
 		return res, err
 	}
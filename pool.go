@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+)
+
+var errPoolClosed = errors.New("worker pool is closed")
+
+// poolResult is what a worker pool reports for one item.
+type poolResult[R any] struct {
+	Value R
+	Err   error
+}
+
+type poolTask[T any, R any] struct {
+	item   T
+	seq    int64
+	result chan poolResult[R]
+}
+
+// taskQueue is a heap of tasks ordered by cmp, then by submission.
+type taskQueue[T any, R any] struct {
+	tasks []*poolTask[T, R]
+	cmp   func(a, b T) int
+}
+
+func (q *taskQueue[T, R]) Len() int { return len(q.tasks) }
+func (q *taskQueue[T, R]) Less(i, j int) bool {
+	if q.cmp != nil {
+		if c := q.cmp(q.tasks[i].item, q.tasks[j].item); c != 0 {
+			return c < 0
+		}
+	}
+	return q.tasks[i].seq < q.tasks[j].seq
+}
+func (q *taskQueue[T, R]) Swap(i, j int) { q.tasks[i], q.tasks[j] = q.tasks[j], q.tasks[i] }
+func (q *taskQueue[T, R]) Push(x any)   { q.tasks = append(q.tasks, x.(*poolTask[T, R])) }
+func (q *taskQueue[T, R]) Pop() any {
+	n := len(q.tasks)
+	t := q.tasks[n-1]
+	q.tasks[n-1] = nil
+	q.tasks = q.tasks[:n-1]
+	return t
+}
+
+// workerPool runs f on submitted items with a number of workers that can be
+// changed while it runs. Waiting items are started in the order given by cmp,
+// or in submission order if cmp is nil; items can be submitted at any time
+// until the pool is closed.
+type workerPool[T any, R any] struct {
+	f      func(T, context.Context) (R, error)
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   taskQueue[T, R]
+	seq     int64
+	size    int // wanted number of workers
+	running int // started workers that have not exited yet
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool[T any, R any](ctx context.Context, f func(T, context.Context) (R, error), workers int, cmp func(a, b T) int) *workerPool[T, R] {
+	p := &workerPool[T, R]{f: f, queue: taskQueue[T, R]{cmp: cmp}}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.cond = sync.NewCond(&p.mu)
+	p.Resize(workers)
+	return p
+}
+
+// Submit queues an item. Its result is sent on the returned channel, which is
+// buffered so nobody has to read it.
+func (p *workerPool[T, R]) Submit(item T) <-chan poolResult[R] {
+	result := make(chan poolResult[R], 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		var zero R
+		result <- poolResult[R]{zero, errPoolClosed}
+		return result
+	}
+	p.seq++
+	heap.Push(&p.queue, &poolTask[T, R]{item: item, seq: p.seq, result: result})
+	p.cond.Signal()
+	return result
+}
+
+// Resize changes the number of workers. Surplus workers exit after finishing
+// their current item.
+func (p *workerPool[T, R]) Resize(workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = max(1, workers)
+	for p.running < p.size {
+		p.running++
+		p.wg.Add(1)
+		go p.work()
+	}
+	p.cond.Broadcast()
+}
+
+// Size returns the number of workers the pool is running with.
+func (p *workerPool[T, R]) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Pending returns the number of items that have not been started yet.
+func (p *workerPool[T, R]) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queue.Len()
+}
+
+// Close stops accepting items. Queued items are still run.
+func (p *workerPool[T, R]) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// Cancel cancels the context of running items; queued items fail with the
+// context error.
+func (p *workerPool[T, R]) Cancel() {
+	p.cancel()
+}
+
+// Wait blocks until the pool is closed and every item has been run.
+func (p *workerPool[T, R]) Wait() {
+	p.wg.Wait()
+}
+
+func (p *workerPool[T, R]) work() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for p.queue.Len() == 0 && !p.closed && p.running <= p.size {
+			p.cond.Wait()
+		}
+		if p.running > p.size || p.queue.Len() == 0 {
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&p.queue).(*poolTask[T, R])
+		p.mu.Unlock()
+
+		if err := p.ctx.Err(); err != nil {
+			var zero R
+			t.result <- poolResult[R]{zero, err}
+			continue
+		}
+		value, err := p.f(t.item, p.ctx)
+		t.result <- poolResult[R]{value, err}
+	}
+}
+
+// runPool runs f on all items with a worker pool and collects the results.
+// The first error, or the end of parent, cancels the remaining items.
+func runPool[T comparable, R any](parent context.Context, f func(T, context.Context) (R, error), items []T, workers int, cmp func(a, b T) int) (map[T]R, error) {
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+	pool := newWorkerPool(ctx, func(item T, ctx context.Context) (R, error) {
+		value, err := f(item, ctx)
+		if err != nil {
+			cancel(err)
+		}
+		return value, err
+	}, workers, cmp)
+	channels := make([]<-chan poolResult[R], len(items))
+	for i, item := range items {
+		channels[i] = pool.Submit(item)
+	}
+	pool.Close()
+	pool.Wait()
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	results := make(map[T]R, len(items))
+	for i, item := range items {
+		results[item] = (<-channels[i]).Value
+	}
+	return results, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		cmp  func(a, b int) int
+		want []int
+	}{
+		{"submission order", nil, []int{3, 1, 4, 2, 5}},
+		{"ascending", cmp.Compare[int], []int{1, 2, 3, 4, 5}},
+		{"descending", func(a, b int) int { return cmp.Compare(b, a) }, []int{5, 4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocking, gate := make(chan struct{}), make(chan struct{})
+			var mu sync.Mutex
+			var started []int
+			pool := newWorkerPool(context.Background(), func(i int, ctx context.Context) (int, error) {
+				if i == 0 {
+					close(blocking)
+					<-gate
+					return 0, nil
+				}
+				mu.Lock()
+				started = append(started, i)
+				mu.Unlock()
+				return i * 2, nil
+			}, 1, tt.cmp)
+			// the only worker is busy while the items are queued
+			pool.Submit(0)
+			<-blocking
+			var results []<-chan poolResult[int]
+			for _, i := range []int{3, 1, 4, 2, 5} {
+				results = append(results, pool.Submit(i))
+			}
+			close(gate)
+			pool.Close()
+			pool.Wait()
+			if !slices.Equal(started, tt.want) {
+				t.Errorf("started %v, want %v", started, tt.want)
+			}
+			for i, item := range []int{3, 1, 4, 2, 5} {
+				if r := <-results[i]; r.Value != item*2 || r.Err != nil {
+					t.Errorf("result of %d = %+v", item, r)
+				}
+			}
+		})
+	}
+}
+
+func TestRunPoolCancel(t *testing.T) {
+	failed := errors.New("failed")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		fail int // item that fails, 0 for none
+		want error
+	}{
+		{"done", context.Background(), 0, nil},
+		{"item fails", context.Background(), 3, failed},
+		{"parent canceled", canceled, 0, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := runPool(tt.ctx, func(i int, ctx context.Context) (int, error) {
+				if i == tt.fail {
+					return 0, failed
+				}
+				if tt.fail != 0 {
+					// the other items run until the failure cancels them
+					<-ctx.Done()
+					return 0, ctx.Err()
+				}
+				return i, nil
+			}, []int{1, 2, 3, 4, 5, 6}, 4, nil)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err == nil && len(results) != 6 {
+				t.Errorf("%d results, want 6", len(results))
+			}
+		})
+	}
+}
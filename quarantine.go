@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const quarantineDirName = ".quarantine"
+const quarantineReasonExt = ".reason.json"
+
+const quarantineUsage = `Usage:
+  phoning-downloader quarantine list [-o <dir>]
+  phoning-downloader quarantine restore [-o <dir>] <liveId or file>...
+  phoning-downloader quarantine purge [-o <dir>] [-older-than <duration>] [-all] [liveId or file...]`
+
+// quarantineRecord is written next to a quarantined file and tells why it was moved there.
+type quarantineRecord struct {
+	LiveId       int               `json:"liveId"`
+	File         string            `json:"file"` // name in the output directory
+	Reason       string            `json:"reason"`
+	ExpectedSize int64             `json:"expectedSize,omitempty"`
+	ActualSize   int64             `json:"actualSize"`
+	Expected     map[string]string `json:"expected,omitempty"`
+	Actual       map[string]string `json:"actual,omitempty"`
+	Quarantined  time.Time         `json:"quarantined"`
+
+	stored string // name in the quarantine folder
+}
+
+// newQuarantineRecord describes a call file that does not match its manifest entry.
+// actual may be nil if the file was not hashed.
+func newQuarantineRecord(liveId int, entry manifestEntry, actual map[string]string, reason error) quarantineRecord {
+	return quarantineRecord{
+		LiveId:       liveId,
+		File:         strconv.Itoa(liveId) + ".mp4",
+		Reason:       reason.Error(),
+		ExpectedSize: entry.Size,
+		Expected:     entry.Hashes,
+		Actual:       actual,
+	}
+}
+
+// quarantineFile moves record.File of dir into the quarantine folder of dir instead
+// of deleting it, writes the record next to it and returns the new path. An older
+// quarantined copy is not overwritten.
+func quarantineFile(dir string, record quarantineRecord) (string, error) {
+	qdir := filepath.Join(dir, quarantineDirName)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return "", err
+	}
+	src := filepath.Join(dir, record.File)
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	stored := record.File
+	if _, err := os.Stat(filepath.Join(qdir, stored)); err == nil {
+		stored = fmt.Sprintf("%s.%d", record.File, time.Now().UnixNano())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	record.ActualSize = info.Size()
+	record.Quarantined = time.Now()
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(qdir, stored)
+	if err := os.WriteFile(dest+quarantineReasonExt, data, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(src, dest); err != nil {
+		os.Remove(dest + quarantineReasonExt)
+		return "", err
+	}
+	slog.Info("Quarantined file", "liveId", record.LiveId, "dest", dest, "reason", record.Reason)
+	return dest, nil
+}
+
+// quarantined lists the files in the quarantine folder of dir, oldest first.
+// Files without a readable record are listed with what is known about them.
+func quarantined(dir string) ([]quarantineRecord, error) {
+	qdir := filepath.Join(dir, quarantineDirName)
+	files, err := os.ReadDir(qdir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []quarantineRecord
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasSuffix(name, quarantineReasonExt) {
+			continue
+		}
+		var record quarantineRecord
+		data, err := os.ReadFile(filepath.Join(qdir, name+quarantineReasonExt))
+		if err == nil {
+			err = json.Unmarshal(data, &record)
+		}
+		if err != nil {
+			info, statErr := file.Info()
+			if statErr != nil {
+				return nil, statErr
+			}
+			record = quarantineRecord{File: name, Reason: "unknown", ActualSize: info.Size(), Quarantined: info.ModTime()}
+			if base, _, ok := strings.Cut(name, ".mp4"); ok {
+				record.File = base + ".mp4"
+				record.LiveId, _ = strconv.Atoi(base)
+			}
+		}
+		record.stored = name
+		records = append(records, record)
+	}
+	slices.SortFunc(records, func(a, b quarantineRecord) int {
+		return a.Quarantined.Compare(b.Quarantined)
+	})
+	return records, nil
+}
+
+func (r quarantineRecord) path(dir string) string {
+	return filepath.Join(dir, quarantineDirName, r.stored)
+}
+
+func (r quarantineRecord) remove(dir string) error {
+	if err := os.Remove(r.path(dir)); err != nil {
+		return err
+	}
+	os.Remove(r.path(dir) + quarantineReasonExt)
+	return nil
+}
+
+// matches reports whether a command line argument, a live ID or a stored file name, refers to r.
+func (r quarantineRecord) matches(arg string) bool {
+	return arg == r.stored || arg == strconv.Itoa(r.LiveId)
+}
+
+// purgeQuarantined deletes the quarantined copies of a call, once a replacement
+// has been downloaded and verified.
+func purgeQuarantined(dir string, liveId int) (int, error) {
+	records, err := quarantined(dir)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, record := range records {
+		if record.LiveId != liveId {
+			continue
+		}
+		if err := record.remove(dir); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// quarantineCommand runs a quarantine subcommand. Listings and what was restored
+// or deleted are plain command output on stdout; errors are logged.
+func quarantineCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, quarantineUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "list":
+		quarantineList(args[1:])
+	case "restore":
+		quarantineRestore(args[1:])
+	case "purge":
+		quarantinePurge(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, quarantineUsage)
+		os.Exit(2)
+	}
+}
+
+func quarantineList(args []string) {
+	flags := flag.NewFlagSet("quarantine list", flag.ExitOnError)
+	outputDir := flags.String("o", "Downloads", "Directory with downloaded videos")
+	logging := addLogFlags(flags)
+	flags.Parse(args)
+	closeLog, err := setupLogging(logging())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	records, err := quarantined(*outputDir)
+	if err != nil {
+		fatal("Error reading quarantine", "err", err)
+	}
+	if len(records) == 0 {
+		fmt.Println("Nothing is quarantined.")
+		return
+	}
+	for _, r := range records {
+		fmt.Printf("%s  %-20s %10s  %s\n", r.Quarantined.Format(time.DateTime), r.stored, formatByteSize(r.ActualSize), r.Reason)
+	}
+	fmt.Printf("%d files in %s\n", len(records), filepath.Join(*outputDir, quarantineDirName))
+}
+
+// quarantineRestore moves quarantined files back. If a call has several
+// quarantined copies, the newest one is restored.
+func quarantineRestore(args []string) {
+	flags := flag.NewFlagSet("quarantine restore", flag.ExitOnError)
+	outputDir := flags.String("o", "Downloads", "Directory with downloaded videos")
+	logging := addLogFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, quarantineUsage)
+		os.Exit(2)
+	}
+	closeLog, err := setupLogging(logging())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	records, err := quarantined(*outputDir)
+	if err != nil {
+		fatal("Error reading quarantine", "err", err)
+	}
+	library, err := loadLibraryIndex(*outputDir)
+	if err != nil {
+		fatal("Error loading library index", "err", err)
+	}
+	failed := false
+	for _, arg := range flags.Args() {
+		i := len(records) - 1
+		for i >= 0 && !records[i].matches(arg) {
+			i--
+		}
+		if i < 0 {
+			slog.Error("Not quarantined", "file", arg)
+			failed = true
+			continue
+		}
+		r := records[i]
+		dest := filepath.Join(*outputDir, r.File)
+		if _, err := os.Stat(dest); err == nil {
+			slog.Error("File exists, not restoring", "file", dest, "quarantined", r.stored)
+			failed = true
+			continue
+		}
+		if err := os.Rename(r.path(*outputDir), dest); err != nil {
+			slog.Error("Could not restore file", "file", r.stored, "err", err)
+			failed = true
+			continue
+		}
+		os.Remove(r.path(*outputDir) + quarantineReasonExt)
+		library.forget(strconv.Itoa(r.LiveId))
+		records = slices.Delete(records, i, i+1)
+		fmt.Printf("Restored %s\n", dest)
+	}
+	if err := library.save(); err != nil {
+		fatal("Error saving library index", "err", err)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func quarantinePurge(args []string) {
+	flags := flag.NewFlagSet("quarantine purge", flag.ExitOnError)
+	outputDir := flags.String("o", "Downloads", "Directory with downloaded videos")
+	olderThan := flags.Duration("older-than", 0, "Only delete files quarantined longer than this, e.g. 720h")
+	all := flags.Bool("all", false, "Delete every quarantined file")
+	logging := addLogFlags(flags)
+	flags.Parse(args)
+	closeLog, err := setupLogging(logging())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	if flags.NArg() == 0 && *olderThan == 0 && !*all {
+		fatal("Name the files to delete, or pass -older-than or -all")
+	}
+	records, err := quarantined(*outputDir)
+	if err != nil {
+		fatal("Error reading quarantine", "err", err)
+	}
+	var purged int
+	var freed int64
+	for _, r := range records {
+		if flags.NArg() > 0 && !slices.ContainsFunc(flags.Args(), r.matches) {
+			continue
+		}
+		if *olderThan > 0 && time.Since(r.Quarantined) < *olderThan {
+			continue
+		}
+		if err := r.remove(*outputDir); err != nil {
+			fatal("Error deleting quarantined file", "file", r.stored, "err", err)
+		}
+		purged++
+		freed += r.ActualSize
+	}
+	fmt.Printf("Deleted %d quarantined files, %s freed.\n", purged, formatByteSize(freed))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateWindow is a daily time range with its own rate, e.g. "09:00-18:00=5M".
+// A window whose end is before its start wraps past midnight.
+type rateWindow struct {
+	start, end time.Duration // offsets from midnight
+	rate       int64
+}
+
+func (w rateWindow) contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	now := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.start <= w.end {
+		return now >= w.start && now < w.end
+	}
+	return now >= w.start || now < w.end
+}
+
+// parseClock parses "HH:MM" into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseRateSchedule parses a comma separated list of windows such as
+// "09:00-18:00=5M,22:00-06:00=50M". A rate of 0 means unlimited.
+func parseRateSchedule(s string) ([]rateWindow, error) {
+	var windows []rateWindow
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		span, rateStr, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry %q, expected HH:MM-HH:MM=RATE", part)
+		}
+		from, to, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry %q, expected HH:MM-HH:MM=RATE", part)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := parseByteSize(rateStr)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, rateWindow{start: start, end: end, rate: rate})
+	}
+	return windows, nil
+}
+
+// rateLimiter is a token bucket shared by every download stream.
+// The bucket holds at most one second worth of tokens; a rate of 0 disables limiting.
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []rateWindow
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(rate int64, schedule []rateWindow) *rateLimiter {
+	return &rateLimiter{rate: rate, schedule: schedule, last: time.Now()}
+}
+
+// SetRate changes the base rate, which applies outside of scheduled windows.
+func (l *rateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+}
+
+// Rate returns the rate in effect right now.
+func (l *rateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentRate(time.Now())
+}
+
+func (l *rateLimiter) currentRate(now time.Time) int64 {
+	for _, w := range l.schedule {
+		if w.contains(now) {
+			return w.rate
+		}
+	}
+	return l.rate
+}
+
+// WaitN takes n tokens from the bucket, blocking until the bucket has paid them back.
+func (l *rateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.currentRate(now)
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return nil
+	}
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(rate), float64(rate))
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+	if debt >= 0 {
+		return nil
+	}
+	return sleepContext(ctx, time.Duration(-debt/float64(rate)*float64(time.Second)))
+}
+
+// limitedReader throttles reads from r through a shared rateLimiter.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if waitErr := l.limiter.WaitN(l.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func newLimitedReader(ctx context.Context, r io.Reader, limiter *rateLimiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: limiter}
+}
+
+// serveRateControl exposes the limiter on a local address so the rate can be
+// changed while downloads are running:
+//
+//	curl localhost:7070/limit            # current rate
+//	curl -X PUT localhost:7070/limit?rate=5M
+func serveRateControl(addr string, limiter *rateLimiter) (*http.Server, error) {
+	mux := http.NewServeMux()
+	handleRateControl(mux, limiter)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(listener)
+	return server, nil
+}
+
+// handleRateControl registers GET and PUT /limit on mux.
+func handleRateControl(mux *http.ServeMux, limiter *rateLimiter) {
+	mux.HandleFunc("GET /limit", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"rate": limiter.Rate()})
+	})
+	mux.HandleFunc("PUT /limit", func(w http.ResponseWriter, r *http.Request) {
+		rate, err := parseByteSize(r.URL.Query().Get("rate"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limiter.SetRate(rate)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"rate": limiter.Rate()})
+	})
+}
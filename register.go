@@ -3,10 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 )
 
-func register() (map[string]string, error) {
-	cookieData, client, err := getCookie()
+func register(apiClient *http.Client) (map[string]string, error) {
+	cookieData, client, err := getCookie(apiClient)
 	if err != nil {
 		return nil, fmt.Errorf("error getting cookies: %v", err)
 	}
@@ -16,7 +17,7 @@ func register() (map[string]string, error) {
 	}
 	password := generatePassword(16)
 	nickname := generateNickname()
-	_, err = signUp(email, password, nickname)
+	_, err = signUp(apiClient, email, password, nickname)
 	if err != nil {
 		return nil, fmt.Errorf("error signing up: %v", err)
 	}
@@ -28,7 +29,7 @@ func register() (map[string]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error clicking link: %v", err)
 	}
-	val, err := check_verification(email)
+	val, err := check_verification(apiClient, email)
 	if err != nil {
 		return nil, fmt.Errorf("error checking verification: %v", err)
 	}
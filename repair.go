@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/vbauerster/mpb/v8"
+	"golang.org/x/sync/errgroup"
+)
+
+// canRepair reports whether an entry has block hashes that cover its whole size.
+func (e manifestEntry) canRepair() bool {
+	if e.Size <= 0 || e.BlockSize <= 0 {
+		return false
+	}
+	return int64(len(e.Blocks)) == (e.Size+e.BlockSize-1)/e.BlockSize
+}
+
+// badBlocks hashes a local file block by block and returns the byte ranges that
+// differ from the entry, with adjacent blocks merged. ok reports whether the
+// file already matches the entry as a whole.
+func badBlocks(path string, entry manifestEntry) (ranges []*chunk, ok bool, err error) {
+	if !entry.canRepair() {
+		return nil, false, fmt.Errorf("no usable block hashes")
+	}
+	local, err := hashFile(path, entry.algorithms(), entry.BlockSize)
+	if err != nil {
+		return nil, false, err
+	}
+	if entry.verify(local.Size, local.Hashes) == nil {
+		return nil, true, nil
+	}
+	for i, want := range entry.Blocks {
+		if i < len(local.Blocks) && local.Blocks[i] == want && min(int64(i+1)*entry.BlockSize, entry.Size) <= local.Size {
+			continue
+		}
+		start := int64(i) * entry.BlockSize
+		end := min(start+entry.BlockSize, entry.Size) - 1
+		if n := len(ranges); n > 0 && ranges[n-1].end+1 == start {
+			ranges[n-1].end = end
+			continue
+		}
+		ranges = append(ranges, newChunk(start, end))
+	}
+	return ranges, false, nil
+}
+
+func rangesSize(ranges []*chunk) int64 {
+	var size int64
+	for _, r := range ranges {
+		size += r.end - r.offset.Load() + 1
+	}
+	return size
+}
+
+// repairBlocks downloads the given ranges into the file, using up to opts.Chunks
+// requests at once, and then verifies the whole file against the entry.
+func repairBlocks(ctx context.Context, url, path string, entry manifestEntry, ranges []*chunk, opts downloadOptions, bar *mpb.Bar) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != entry.Size {
+		if err := file.Truncate(entry.Size); err != nil {
+			return fmt.Errorf("resizing file: %w", err)
+		}
+	}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(max(1, opts.Chunks))
+	for _, r := range ranges {
+		eg.Go(func() error {
+			return fetchChunk(egCtx, url, file, r, opts, bar)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	repaired, err := hashFile(path, entry.algorithms(), 0)
+	if err != nil {
+		return err
+	}
+	if err := entry.verify(repaired.Size, repaired.Hashes); err != nil {
+		return fmt.Errorf("still corrupted after repair: %w", err)
+	}
+	return nil
+}
+
+// repairCall checks a call file against the block hashes of its entry and fixes
+// it in place. It returns how many bytes had to be downloaded, 0 if the file was
+// already intact.
+func repairCall(ctx context.Context, s *session, p *mpb.Progress, liveId int, path string, entry manifestEntry, opts downloadOptions) (int64, error) {
+	ranges, ok, err := badBlocks(path, entry)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return 0, nil
+	}
+	url, err := s.videoURL(liveId)
+	if err != nil {
+		return 0, err
+	}
+	size := rangesSize(ranges)
+	bar := newFileBar(p, strconv.Itoa(liveId), size)
+	if err := repairBlocks(ctx, url, path, entry, ranges, opts, bar); err != nil {
+		bar.Abort(true)
+		return size, err
+	}
+	slog.Info("Repaired file", "liveId", liveId, "ranges", len(ranges), "bytes", size)
+	return size, nil
+}
+
+// repairCommand repairs corrupted call files in the output directory by
+// downloading only the blocks that differ from the manifest.
+func repairCommand(args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	outputDir := flags.String("o", "Downloads", "Directory with downloaded videos")
+	concurrency := flags.Int("c", 4, "Files checked in parallel")
+	chunk := flags.Int("d", 4, "Block ranges downloaded in parallel per file")
+	manifestSource := flags.String("manifest", "", "Hash file path or HTTPS URL (default is the hash file built into the binary)")
+	manifestKey := flags.String("manifest-key", manifestPublicKey, "Base64 ed25519 public key for remote hash files")
+	transport := addTransportFlags(flags)
+	logging := addLogFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: phoning-downloader repair [flags] [liveId...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	closeLog, err := setupLogging(logging())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	if *concurrency < 1 || *chunk < 1 {
+		fatal("Concurrency must be at least 1")
+	}
+	clients, err := newHTTPClients(transport())
+	if err != nil {
+		fatal("Invalid connection settings", "err", err)
+	}
+	m, err := openManifest(context.Background(), clients.API, *manifestSource, *manifestKey)
+	if err != nil {
+		fatal("Error loading hash file", "err", err)
+	}
+
+	var liveIds []int
+	if flags.NArg() > 0 {
+		for _, arg := range flags.Args() {
+			liveId, err := strconv.Atoi(arg)
+			if err != nil {
+				fatal("Invalid live ID", "arg", arg)
+			}
+			liveIds = append(liveIds, liveId)
+		}
+	} else {
+		files, err := os.ReadDir(*outputDir)
+		if err != nil {
+			fatal("Failed to read output directory", "err", err)
+		}
+		for _, file := range files {
+			if liveId, ok := parseCallFileName(file.Name()); ok && !file.IsDir() {
+				liveIds = append(liveIds, liveId)
+			}
+		}
+	}
+	var repairable []int
+	for _, liveId := range liveIds {
+		if m.Calls[strconv.Itoa(liveId)].canRepair() {
+			repairable = append(repairable, liveId)
+		}
+	}
+	fmt.Printf("%d of %d files have block hashes and can be repaired.\n", len(repairable), len(liveIds))
+	if len(repairable) == 0 {
+		return
+	}
+
+	s, err := newSession(clients)
+	if err != nil {
+		fatal(err.Error())
+	}
+	opts := downloadOptions{Chunks: *chunk, Client: clients.Download}
+	p := mpb.New(mpb.WithWidth(64), mpb.PopCompletedMode())
+	restoreLog := logAbove(p)
+	var intact, repaired, failed atomic.Int64
+	repairFunction := func(liveId int, ctx context.Context) (int64, error) {
+		path := filepath.Join(*outputDir, strconv.Itoa(liveId)+".mp4")
+		fetched, err := repairCall(ctx, s, p, liveId, path, m.Calls[strconv.Itoa(liveId)], opts)
+		switch {
+		case err != nil:
+			failed.Add(1)
+			slog.Warn("Could not repair file", "liveId", liveId, "err", err)
+		case fetched > 0:
+			repaired.Add(1)
+		default:
+			intact.Add(1)
+		}
+		// failures are counted, not fatal for the other files
+		return fetched, nil
+	}
+	fetched, err := runPool(context.Background(), repairFunction, repairable, *concurrency, nil)
+	p.Wait()
+	restoreLog()
+	if err != nil {
+		fatal("Error repairing files", "err", err)
+	}
+	var total int64
+	for _, n := range fetched {
+		total += n
+	}
+	fmt.Printf("%d intact, %d repaired (%s downloaded), %d failed.\n", intact.Load(), repaired.Load(), formatByteSize(total), failed.Load())
+	if failed.Load() > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+)
+
+func TestBadBlocks(t *testing.T) {
+	video := make([]byte, 2500)
+	for i := range video {
+		video[i] = byte(i * 7)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "169.mp4")
+	if err := os.WriteFile(path, video, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := hashFile(path, []string{"sha256"}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		flip   []int // bytes to corrupt
+		length int   // file length
+		want   [][2]int64
+	}{
+		{"intact", nil, 2500, nil},
+		{"one block", []int{10}, 2500, [][2]int64{{0, 999}}},
+		{"adjacent blocks merged", []int{999, 1000}, 2500, [][2]int64{{0, 1999}}},
+		{"separate blocks", []int{10, 2400}, 2500, [][2]int64{{0, 999}, {2000, 2499}}},
+		{"truncated", nil, 1500, [][2]int64{{1000, 2499}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Clone(video[:tt.length])
+			for _, i := range tt.flip {
+				data[i] ^= 1
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			ranges, ok, err := badBlocks(path, entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (tt.want == nil) {
+				t.Errorf("ok = %v", ok)
+			}
+			var got [][2]int64
+			for _, r := range ranges {
+				got = append(got, [2]int64{r.start, r.end})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ranges %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ranges %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRepairBlocks(t *testing.T) {
+	video := bytes.Repeat([]byte("phoning!"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(video))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "169.mp4")
+	if err := os.WriteFile(path, video, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := hashFile(path, []string{"sha256"}, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Clone(video[:7000])
+	corrupted[100] ^= 1
+	corrupted[5000] ^= 1
+	if err := os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges, _, err := badBlocks(path, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested := rangesSize(ranges)
+	bar := mpb.New(mpb.WithOutput(nil)).New(0, mpb.NopStyle())
+	if err := repairBlocks(context.Background(), server.URL, path, entry, ranges, downloadOptions{Chunks: 2}, bar); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, video) {
+		t.Error("repaired file differs from the video")
+	}
+	// blocks 0, 4 and everything from 6 on
+	if want := int64(1024 + 1024 + len(video) - 6*1024); requested != want {
+		t.Errorf("repaired %d bytes, want %d", requested, want)
+	}
+}
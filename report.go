@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var reportFormats = []string{"json", "markdown"}
+
+// hash outcomes counted by the report, besides the ok, mismatch and error of the metrics
+const (
+	hashRepaired   = "repaired"
+	hashUnverified = "unverified"
+)
+
+// runReport summarizes a download run. It is printed as a table at the end and
+// can be written to the output directory. A nil *runReport records nothing.
+type runReport struct {
+	mu sync.Mutex
+
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished"`
+	Duration    float64        `json:"durationSeconds"`
+	Listed      int            `json:"listed"`
+	Downloaded  int            `json:"downloaded"`
+	Skipped     int            `json:"skipped"` // existing files that were kept
+	Repaired    int            `json:"repaired"`
+	Quarantined int            `json:"quarantined"`
+	Failed      int            `json:"failed"`
+	Interrupted int            `json:"interrupted"` // stopped by a pause or another failure
+	Paused      bool           `json:"paused,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Bytes       int64          `json:"bytes"`      // transferred while downloading
+	Throughput  float64        `json:"throughput"` // bytes per second while downloading
+	Retries     int64          `json:"retries"`
+	Hashes      map[string]int `json:"hashes"` // outcome to count
+	Order       string         `json:"order,omitempty"`
+	Calls       []callReport   `json:"calls"` // in download order
+
+	downloading time.Time // when downloads started
+	bytesBefore int64
+	rank        map[int]int // position of a call in the download order
+}
+
+// callReport is a call that was downloaded, or tried to be, in a run.
+type callReport struct {
+	LiveId   int     `json:"liveId"`
+	Size     int64   `json:"size"`
+	Result   string  `json:"result"` // downloaded, failed or interrupted
+	Duration float64 `json:"durationSeconds"`
+	Retries  int64   `json:"retries"`
+	Hash     string  `json:"hash,omitempty"` // ok, mismatch or unverified, empty if not downloaded
+	Error    string  `json:"error,omitempty"`
+}
+
+func newRunReport(started time.Time) *runReport {
+	return &runReport{Started: started, Hashes: make(map[string]int)}
+}
+
+// parseReportFormats parses the -report flag, a comma-separated list of formats.
+func parseReportFormats(s string) ([]string, error) {
+	var formats []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "md" {
+			f = "markdown"
+		}
+		switch {
+		case f == "":
+		case !slices.Contains(reportFormats, f):
+			return nil, fmt.Errorf("invalid report format %q, expected %s", f, strings.Join(reportFormats, " or "))
+		case !slices.Contains(formats, f):
+			formats = append(formats, f)
+		}
+	}
+	return formats, nil
+}
+
+func (r *runReport) hash(outcome string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Hashes[outcome]++
+}
+
+// startDownloads marks the start of the download phase, which the throughput is
+// measured over. liveIds are the calls to download, sorted by order.
+func (r *runReport) startDownloads(order string, liveIds []int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.downloading = time.Now()
+	r.bytesBefore = stats.downloadedBytes.Load()
+	r.Order = order
+	r.rank = make(map[int]int, len(liveIds))
+	for i, liveId := range liveIds {
+		r.rank[liveId] = i
+	}
+}
+
+func (r *runReport) addCall(c callReport) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch c.Result {
+	case "downloaded":
+		r.Downloaded++
+	case "failed":
+		r.Failed++
+	default:
+		r.Interrupted++
+	}
+	r.Retries += c.Retries
+	if c.Hash != "" {
+		r.Hashes[c.Hash]++
+	}
+	r.Calls = append(r.Calls, c)
+}
+
+// finish completes the report once the run is over; err is what stopped it, if anything.
+func (r *runReport) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if !r.downloading.IsZero() {
+		r.Bytes = stats.downloadedBytes.Load() - r.bytesBefore
+		if elapsed := r.Finished.Sub(r.downloading).Seconds(); elapsed > 0 {
+			r.Throughput = float64(r.Bytes) / elapsed
+		}
+	}
+	// calls are added as they finish; list them in the order they started
+	slices.SortStableFunc(r.Calls, func(a, b callReport) int { return r.rank[a.LiveId] - r.rank[b.LiveId] })
+}
+
+func (r *runReport) counts() [][2]string {
+	rows := [][2]string{
+		{"Listed", fmt.Sprint(r.Listed)},
+		{"Downloaded", fmt.Sprint(r.Downloaded)},
+		{"Skipped (existing)", fmt.Sprint(r.Skipped)},
+		{"Repaired", fmt.Sprint(r.Repaired)},
+		{"Quarantined", fmt.Sprint(r.Quarantined)},
+		{"Failed", fmt.Sprint(r.Failed)},
+	}
+	if r.Interrupted > 0 {
+		rows = append(rows, [2]string{"Interrupted", fmt.Sprint(r.Interrupted)})
+	}
+	if r.Order != "" {
+		rows = append(rows, [2]string{"Order", r.Order})
+	}
+	rows = append(rows,
+		[2]string{"Transferred", formatByteSize(r.Bytes)},
+		[2]string{"Throughput", formatByteSize(int64(r.Throughput)) + "/s"},
+		[2]string{"Duration", seconds(r.Duration).String()},
+		[2]string{"Retries", fmt.Sprint(r.Retries)},
+	)
+	outcomes := make([]string, 0, len(r.Hashes))
+	for outcome := range r.Hashes {
+		outcomes = append(outcomes, outcome)
+	}
+	slices.Sort(outcomes)
+	for _, outcome := range outcomes {
+		rows = append(rows, [2]string{"Hash " + outcome, fmt.Sprint(r.Hashes[outcome])})
+	}
+	return rows
+}
+
+// print writes the report as aligned tables: the totals, then every call.
+func (r *runReport) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Summary")
+	for _, row := range r.counts() {
+		fmt.Fprintf(tw, "  %s\t%s\n", row[0], row[1])
+	}
+	if len(r.Calls) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "  Live ID\tResult\tSize\tDuration\tRetries\tHash\tError")
+		for _, c := range r.Calls {
+			fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\t%d\t%s\t%s\n", c.LiveId, c.Result, formatByteSize(c.Size), seconds(c.Duration), c.Retries, c.Hash, c.Error)
+		}
+	}
+	if r.Error != "" {
+		fmt.Fprintln(tw)
+		fmt.Fprintf(tw, "Stopped by: %s\n", r.Error)
+	}
+	tw.Flush()
+}
+
+func (r *runReport) markdown(w io.Writer) {
+	fmt.Fprintf(w, "# Download report %s\n\n", r.Started.Format(time.DateTime))
+	fmt.Fprintln(w, "| | |\n| --- | --- |")
+	for _, row := range r.counts() {
+		fmt.Fprintf(w, "| %s | %s |\n", row[0], row[1])
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "\nStopped by: %s\n", r.Error)
+	}
+	if len(r.Calls) > 0 {
+		fmt.Fprintln(w, "\n## Calls\n\n| Live ID | Result | Size | Duration | Retries | Hash | Error |\n| --- | --- | --- | --- | --- | --- | --- |")
+		for _, c := range r.Calls {
+			fmt.Fprintf(w, "| %d | %s | %s | %s | %d | %s | %s |\n", c.LiveId, c.Result, formatByteSize(c.Size), seconds(c.Duration), c.Retries, c.Hash, strings.ReplaceAll(c.Error, "|", "\\|"))
+		}
+	}
+}
+
+// write saves the report in each format as phoning-report-<timestamp>.<ext> in
+// dir and returns the paths.
+func (r *runReport) write(dir string, formats []string) ([]string, error) {
+	base := filepath.Join(dir, "phoning-report-"+r.Started.Format("20060102-150405"))
+	var paths []string
+	for _, format := range formats {
+		var sb strings.Builder
+		path := base + ".json"
+		if format == "markdown" {
+			path = base + ".md"
+			r.markdown(&sb)
+		} else {
+			data, err := json.MarshalIndent(r, "", "  ")
+			if err != nil {
+				return paths, err
+			}
+			sb.Write(data)
+			sb.WriteByte('\n')
+		}
+		if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+			return paths, fmt.Errorf("writing report: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// seconds turns a duration in seconds back into a rounded time.Duration for display.
+func seconds(s float64) time.Duration {
+	d := time.Duration(s * float64(time.Second))
+	if d >= time.Minute {
+		return d.Round(time.Second)
+	}
+	return d.Round(100 * time.Millisecond)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"120", 120 * time.Second, 120 * time.Second},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, tt := range tests {
+		if d := parseRetryAfter(tt.value); d < tt.min || d > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v-%v", tt.value, d, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{"first", 0, errors.New("reset"), retryBaseDelay / 2, retryBaseDelay},
+		{"third", 2, errors.New("reset"), 2 * retryBaseDelay, 4 * retryBaseDelay},
+		{"capped", 10, errors.New("reset"), retryMaxDelay / 2, retryMaxDelay},
+		{"no overflow", 100, errors.New("reset"), retryMaxDelay / 2, retryMaxDelay},
+		{"retry after", 0, &statusError{Code: 429, RetryAfter: 7 * time.Second}, 7 * time.Second, 7 * time.Second},
+		{"retry after capped", 0, &statusError{Code: 503, RetryAfter: time.Hour}, retryMaxDelay, retryMaxDelay},
+		{"status without retry after", 1, &statusError{Code: 503}, retryBaseDelay, 2 * retryBaseDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 20 {
+				if d := retryDelay(tt.attempt, tt.err); d < tt.min || d > tt.max {
+					t.Fatalf("retryDelay(%d) = %v, want %v-%v", tt.attempt, d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+)
+
+const (
+	s3PartSize     = 16 << 20 // at least 5 MiB, the smallest part S3 accepts
+	s3MaxParts     = 10000
+	s3MaxCopySize  = 5 << 30 // larger objects have to be copied in parts
+	s3CopyPartSize = 1 << 30
+)
+
+// s3Storage keeps files in a bucket of Amazon S3 or a compatible service such
+// as MinIO, below a key prefix. Requests are signed with AWS Signature Version 4.
+type s3Storage struct {
+	client       *http.Client
+	endpoint     *url.URL
+	pathStyle    bool // bucket in the path instead of the host name, for custom endpoints
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Storage configures a bucket from a URL like s3://bucket/prefix. The
+// credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN. The region and endpoint can be given as ?region= and
+// ?endpoint= or through AWS_REGION and AWS_ENDPOINT_URL_S3.
+func newS3Storage(u *url.URL, client *http.Client) (*s3Storage, error) {
+	s := &s3Storage{
+		client:       client,
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       firstNonEmpty(u.Query().Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("no bucket in %q", u.String())
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY have to be set for S3 storage")
+	}
+	endpoint := firstNonEmpty(u.Query().Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	if endpoint == "" {
+		s.endpoint = &url.URL{Scheme: "https", Host: "s3." + s.region + ".amazonaws.com"}
+	} else {
+		e, err := url.Parse(endpoint)
+		if err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		s.endpoint = &url.URL{Scheme: e.Scheme, Host: e.Host}
+		s.pathStyle = true
+	}
+	return s, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *s3Storage) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+func (s *s3Storage) Location(name string) string {
+	return s.String() + name
+}
+
+// Fetch uploads url as a multipart upload, see uploadVideo.
+func (s *s3Storage) Fetch(ctx context.Context, url, name string, opts downloadOptions, bar *mpb.Bar, check func() error) error {
+	return uploadVideo(ctx, url, s, name, opts, bar, check)
+}
+
+// url is the address of key, or of the bucket if key is empty.
+func (s *s3Storage) url(key string, query map[string]string) *url.URL {
+	u := *s.endpoint
+	p := "/" + key
+	if s.pathStyle {
+		p = "/" + s.bucket + p
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// s3Escape percent-encodes s the way Signature Version 4 expects, keeping
+// slashes unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3Query encodes query parameters sorted by name, which is also their canonical form.
+func s3Query(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	params := make([]string, len(names))
+	for i, name := range names {
+		params[i] = s3Escape(name, true) + "=" + s3Escape(query[name], true)
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the Signature Version 4 authorization to req, covering its host,
+// all headers set so far and the payload with the given hex SHA-256.
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Error is an error response of the S3 API.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 returned status %d", e.Status)
+	}
+	return fmt.Sprintf("S3 returned status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.Status == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+func (e *s3Error) retryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500 || e.Code == "SlowDown" || e.Code == "InternalError"
+}
+
+// s3Request is one call of the S3 API.
+type s3Request struct {
+	method string
+	key    string // empty for requests to the bucket
+	query  map[string]string
+	header map[string]string
+	body   []byte
+	retry  bool // whether the request can be repeated after a server or network error
+}
+
+// do sends r and returns the response body. Error responses, which S3 sends
+// with status 200 for some requests, are returned as *s3Error.
+func (s *s3Storage) do(ctx context.Context, r s3Request) (http.Header, []byte, error) {
+	sum := sha256.Sum256(r.body)
+	payloadHash := hex.EncodeToString(sum[:])
+	attempts := 1
+	if r.retry {
+		attempts = maxRetries
+	}
+	var lastErr error
+	for attempt := range attempts {
+		if attempt > 0 {
+			if err := sleepContext(ctx, retryDelay(attempt-1, lastErr)); err != nil {
+				return nil, nil, err
+			}
+		}
+		header, body, err := s.send(ctx, r, payloadHash)
+		if err == nil {
+			return header, body, nil
+		}
+		var se *s3Error
+		if ctx.Err() != nil || (errors.As(err, &se) && !se.retryable()) {
+			return nil, nil, err
+		}
+		lastErr = err
+		if attempt < attempts-1 {
+			slog.Warn("Retrying S3 request", "method", r.method, "key", r.key, "attempt", attempt+1, "err", err)
+		}
+	}
+	return nil, nil, lastErr
+}
+
+func (s *s3Storage) send(ctx context.Context, r s3Request, payloadHash string) (http.Header, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, r.method, s.url(r.key, r.query).String(), bytes.NewReader(r.body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = int64(len(r.body))
+	for name, value := range r.header {
+		req.Header.Set(name, value)
+	}
+	s.sign(req, payloadHash, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(body, e)
+		return nil, nil, e
+	}
+	if bytes.Contains(body[:min(len(body), 256)], []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		if xml.Unmarshal(body, e) == nil && e.Code != "" {
+			return nil, nil, e
+		}
+	}
+	return resp.Header, body, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (storageObject, error) {
+	header, _, err := s.do(ctx, s3Request{method: http.MethodHead, key: s.prefix + name, retry: true})
+	if err != nil {
+		return storageObject{}, fmt.Errorf("stat %s: %w", name, err)
+	}
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return storageObject{}, fmt.Errorf("stat %s: invalid size: %w", name, err)
+	}
+	modified, _ := http.ParseTime(header.Get("Last-Modified"))
+	return storageObject{Name: name, Size: size, Modified: modified}, nil
+}
+
+func (s *s3Storage) List(ctx context.Context) ([]storageObject, error) {
+	var objects []storageObject
+	query := map[string]string{"list-type": "2", "prefix": s.prefix, "delimiter": "/"}
+	for {
+		_, body, err := s.do(ctx, s3Request{method: http.MethodGet, query: query, retry: true})
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", s, err)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("listing %s: %w", s, err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, storageObject{Name: strings.TrimPrefix(c.Key, s.prefix), Size: c.Size, Modified: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query["continuation-token"] = result.NextContinuationToken
+	}
+}
+
+// Rename copies the object and deletes the original, as S3 cannot move objects.
+func (s *s3Storage) Rename(ctx context.Context, from, to string) error {
+	object, err := s.Stat(ctx, from)
+	if err != nil {
+		return err
+	}
+	source := s3Escape("/"+s.bucket+"/"+s.prefix+from, false)
+	if object.Size <= s3MaxCopySize {
+		_, _, err = s.do(ctx, s3Request{method: http.MethodPut, key: s.prefix + to, header: map[string]string{"X-Amz-Copy-Source": source}, retry: true})
+	} else {
+		err = s.copyParts(ctx, source, to, object.Size)
+	}
+	if err != nil {
+		return fmt.Errorf("copying %s to %s: %w", from, to, err)
+	}
+	return s.Delete(ctx, from)
+}
+
+// copyParts copies a large object with a multipart upload of source ranges.
+func (s *s3Storage) copyParts(ctx context.Context, source, to string, size int64) error {
+	up, err := s.createUpload(ctx, s.prefix+to, size, s3CopyPartSize)
+	if err != nil {
+		return err
+	}
+	for number := 1; int64(number-1)*up.partSize < size; number++ {
+		start := int64(number-1) * up.partSize
+		end := min(start+up.partSize, size) - 1
+		query := map[string]string{"partNumber": strconv.Itoa(number), "uploadId": up.id}
+		header := map[string]string{"X-Amz-Copy-Source": source, "X-Amz-Copy-Source-Range": fmt.Sprintf("bytes=%d-%d", start, end)}
+		_, body, err := s.do(ctx, s3Request{method: http.MethodPut, key: up.key, query: query, header: header, retry: true})
+		if err != nil {
+			up.Abort(context.WithoutCancel(ctx))
+			return err
+		}
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			up.Abort(context.WithoutCancel(ctx))
+			return err
+		}
+		up.etags[number] = result.ETag
+	}
+	return up.Commit(ctx)
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	if _, _, err := s.do(ctx, s3Request{method: http.MethodDelete, key: s.prefix + name, retry: true}); err != nil {
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Create(ctx context.Context, name string, size int64) (storageWriter, error) {
+	// parts have to be large enough that the file fits into the maximum number of them
+	partSize := max(s3PartSize, (size+s3MaxParts-1)/s3MaxParts)
+	return s.createUpload(ctx, s.prefix+name, size, partSize)
+}
+
+func (s *s3Storage) createUpload(ctx context.Context, key string, size, partSize int64) (*s3Upload, error) {
+	_, body, err := s.do(ctx, s3Request{method: http.MethodPost, key: key, query: map[string]string{"uploads": ""}})
+	if err != nil {
+		return nil, fmt.Errorf("starting upload: %w", err)
+	}
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.UploadId == "" {
+		return nil, fmt.Errorf("starting upload: no upload ID in response")
+	}
+	slog.Debug("Started S3 upload", "key", key, "uploadId", result.UploadId, "partSize", partSize)
+	return &s3Upload{s: s, key: key, id: result.UploadId, size: size, partSize: partSize, etags: make(map[int]string)}, nil
+}
+
+// s3Upload is a multipart upload in progress.
+type s3Upload struct {
+	s        *s3Storage
+	key      string
+	id       string
+	size     int64
+	partSize int64
+
+	mu    sync.Mutex
+	etags map[int]string // part number to ETag
+}
+
+func (u *s3Upload) PartSize() int64 {
+	return u.partSize
+}
+
+func (u *s3Upload) WritePart(ctx context.Context, number int, data []byte) error {
+	query := map[string]string{"partNumber": strconv.Itoa(number), "uploadId": u.id}
+	header, _, err := u.s.do(ctx, s3Request{method: http.MethodPut, key: u.key, query: query, body: data, retry: true})
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.etags[number] = header.Get("ETag")
+	return nil
+}
+
+func (u *s3Upload) Commit(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if parts := int((u.size + u.partSize - 1) / u.partSize); len(u.etags) != parts {
+		return fmt.Errorf("%d of %d parts uploaded", len(u.etags), parts)
+	}
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for number, etag := range u.etags {
+		complete.Parts = append(complete.Parts, part{number, etag})
+	}
+	slices.SortFunc(complete.Parts, func(a, b part) int { return a.PartNumber - b.PartNumber })
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	// repeating a completed upload fails, so this one is not retried
+	_, _, err = u.s.do(ctx, s3Request{method: http.MethodPost, key: u.key, query: map[string]string{"uploadId": u.id}, body: body})
+	return err
+}
+
+func (u *s3Upload) Abort(ctx context.Context) error {
+	_, _, err := u.s.do(ctx, s3Request{method: http.MethodDelete, key: u.key, query: map[string]string{"uploadId": u.id}, retry: true})
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileConfig is the JSON file given with -config.
+type fileConfig struct {
+	Schedule *scheduleConfig `json:"schedule,omitempty"`
+	Hooks    []hookConfig    `json:"hooks,omitempty"`
+	Uploads  []uploadConfig  `json:"uploads,omitempty"`
+}
+
+// scheduleConfig is the "schedule" block of the config file, e.g.
+//
+//	{"cron": ["0 3 * * *"], "quietHours": ["08:00-23:00"], "maxRuntime": "2h"}
+type scheduleConfig struct {
+	Cron       []string `json:"cron,omitempty"`       // cron expressions that start a run
+	Every      string   `json:"every,omitempty"`      // or a fixed interval between runs, e.g. "6h"
+	QuietHours []string `json:"quietHours,omitempty"` // daily windows without downloads, e.g. "08:00-23:00"
+	MaxRuntime string   `json:"maxRuntime,omitempty"` // longest a run may download, e.g. "2h"
+}
+
+// loadConfig reads a config file. An empty path gives an empty config.
+func loadConfig(path string) (*fileConfig, error) {
+	cfg := &fileConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// schedule decides when runs start and how long they may download.
+type schedule struct {
+	crons      []*cronExpr
+	every      time.Duration
+	jitter     float64 // applied to every
+	quiet      []rateWindow
+	maxRuntime time.Duration
+}
+
+func newSchedule(cfg scheduleConfig) (*schedule, error) {
+	s := &schedule{}
+	for _, expr := range cfg.Cron {
+		c, err := parseCron(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		s.crons = append(s.crons, c)
+	}
+	var err error
+	if cfg.Every != "" {
+		if s.every, err = time.ParseDuration(cfg.Every); err != nil || s.every <= 0 {
+			return nil, fmt.Errorf("invalid interval %q", cfg.Every)
+		}
+	}
+	if cfg.MaxRuntime != "" {
+		if s.maxRuntime, err = time.ParseDuration(cfg.MaxRuntime); err != nil || s.maxRuntime <= 0 {
+			return nil, fmt.Errorf("invalid maximum runtime %q", cfg.MaxRuntime)
+		}
+	}
+	for _, span := range cfg.QuietHours {
+		from, to, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid quiet hours %q, expected HH:MM-HH:MM", span)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("quiet hours %q are empty", span)
+		}
+		s.quiet = append(s.quiet, rateWindow{start: start, end: end})
+	}
+	return s, nil
+}
+
+// triggered reports whether the schedule starts runs by itself, as opposed to
+// only limiting when runs may download.
+func (s *schedule) triggered() bool {
+	return len(s.crons) > 0 || s.every > 0
+}
+
+// quietUntil returns the end of the quiet hours t falls in, or false if downloads are allowed at t.
+func (s *schedule) quietUntil(t time.Time) (time.Time, bool) {
+	var until time.Time
+	// windows may overlap or follow each other; more passes than windows means they cover the whole day
+	for range len(s.quiet) + 1 {
+		inside := false
+		for _, w := range s.quiet {
+			if w.contains(t) {
+				end := midnight(t).Add(w.end)
+				if !end.After(t) {
+					end = end.AddDate(0, 0, 1)
+				}
+				t, inside = end, true
+			}
+		}
+		if !inside {
+			break
+		}
+		until = t
+	}
+	return until, !until.IsZero()
+}
+
+// nextQuiet returns when the next quiet hours after t begin, or the zero time if there are none.
+func (s *schedule) nextQuiet(t time.Time) time.Time {
+	var next time.Time
+	for _, w := range s.quiet {
+		start := midnight(t).Add(w.start)
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// next returns when the run after one started at last should start. now is
+// the current time; runs never start during quiet hours.
+func (s *schedule) next(last, now time.Time) time.Time {
+	var next time.Time
+	for _, c := range s.crons {
+		if t := c.next(now); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	if s.every > 0 {
+		t := last.Add(jittered(s.every, s.jitter))
+		if t.Before(now) {
+			t = now
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if until, quiet := s.quietUntil(next); quiet {
+		next = until
+	}
+	return next
+}
+
+// deadline returns when a run started at start has to stop downloading: after
+// the maximum runtime or when quiet hours begin, whichever comes first. The
+// zero time means it may run until it is done.
+func (s *schedule) deadline(start time.Time) time.Time {
+	deadline := s.nextQuiet(start)
+	if s.maxRuntime > 0 {
+		if end := start.Add(s.maxRuntime); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+		}
+	}
+	return deadline
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// errPaused is the cause of the context of a run that reached its deadline.
+var errPaused = errors.New("paused until the next run")
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns the given time on Monday, January 5th 2026 plus days.
+func at(days, hour, minute int) time.Time {
+	return time.Date(2026, time.January, 5+days, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"0 3 * * *", true},
+		{"*/15 8-18 * * 1-5", true},
+		{"0 0 1,15 * 7", true},
+		{"@daily", true},
+		{"0 3 * *", false},
+		{"60 3 * * *", false},
+		{"0 3 0 * *", false},
+		{"0 3 * 13 *", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); (err == nil) != tt.ok {
+			t.Errorf("parseCron(%q) err = %v, want ok = %v", tt.expr, err, tt.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"0 3 * * *", at(0, 2, 59), at(0, 3, 0)},
+		{"0 3 * * *", at(0, 3, 0), at(1, 3, 0)},
+		{"*/15 * * * *", at(0, 10, 7), at(0, 10, 15)},
+		{"0 0 * * 0", at(0, 12, 0), at(6, 0, 0)},
+		{"0 0 * * 7", at(0, 12, 0), at(6, 0, 0)},
+		{"30 8 * * 1-5", at(4, 9, 0), at(7, 8, 30)},
+		// a restricted day of month and day of week match either
+		{"0 0 10 * 3", at(0, 12, 0), at(2, 0, 0)},
+		{"@monthly", at(0, 12, 0), time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", at(0, 12, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q after %v = %v, want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleQuietHours(t *testing.T) {
+	tests := []struct {
+		name      string
+		quiet     []string
+		at        time.Time
+		wantUntil time.Time // zero if downloads are allowed
+		wantNext  time.Time
+	}{
+		{"before", []string{"08:00-23:00"}, at(0, 7, 0), time.Time{}, at(0, 8, 0)},
+		{"inside", []string{"08:00-23:00"}, at(0, 12, 0), at(0, 23, 0), at(1, 8, 0)},
+		{"end is allowed", []string{"08:00-23:00"}, at(0, 23, 0), time.Time{}, at(1, 8, 0)},
+		{"over midnight", []string{"22:00-06:00"}, at(0, 23, 0), at(1, 6, 0), at(1, 22, 0)},
+		{"after midnight", []string{"22:00-06:00"}, at(0, 1, 0), at(0, 6, 0), at(0, 22, 0)},
+		{"adjoining windows", []string{"08:00-12:00", "12:00-14:00"}, at(0, 9, 0), at(0, 14, 0), at(0, 12, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSchedule(scheduleConfig{QuietHours: tt.quiet})
+			if err != nil {
+				t.Fatal(err)
+			}
+			until, quiet := s.quietUntil(tt.at)
+			if quiet != !tt.wantUntil.IsZero() || !until.Equal(tt.wantUntil) {
+				t.Errorf("quietUntil = %v, %v, want %v", until, quiet, tt.wantUntil)
+			}
+			if next := s.nextQuiet(tt.at); !next.Equal(tt.wantNext) {
+				t.Errorf("nextQuiet = %v, want %v", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestScheduleQuietAllDay(t *testing.T) {
+	s, err := newSchedule(scheduleConfig{QuietHours: []string{"00:00-12:00", "12:00-00:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// windows covering the whole day must not loop forever
+	if until, quiet := s.quietUntil(at(0, 9, 0)); !quiet || until.Before(at(1, 0, 0)) {
+		t.Errorf("quietUntil = %v, %v, want quiet for at least the day", until, quiet)
+	}
+}
+
+func TestNewScheduleErrors(t *testing.T) {
+	tests := []scheduleConfig{
+		{Cron: []string{"0 3 * *"}},
+		{Every: "often"},
+		{Every: "-1h"},
+		{MaxRuntime: "0s"},
+		{QuietHours: []string{"08:00"}},
+		{QuietHours: []string{"08:00-25:00"}},
+		{QuietHours: []string{"08:00-08:00"}},
+	}
+	for _, cfg := range tests {
+		if _, err := newSchedule(cfg); err == nil {
+			t.Errorf("newSchedule(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestScheduleDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  scheduleConfig
+		want time.Time
+	}{
+		{"unlimited", scheduleConfig{}, time.Time{}},
+		{"max runtime", scheduleConfig{MaxRuntime: "2h"}, at(0, 5, 0)},
+		{"quiet hours first", scheduleConfig{MaxRuntime: "8h", QuietHours: []string{"08:00-23:00"}}, at(0, 8, 0)},
+		{"max runtime first", scheduleConfig{MaxRuntime: "1h", QuietHours: []string{"08:00-23:00"}}, at(0, 4, 0)},
+	}
+	for _, tt := range tests {
+		s, err := newSchedule(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.deadline(at(0, 3, 0)); !got.Equal(tt.want) {
+			t.Errorf("%s: deadline = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
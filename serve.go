@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// callsMaxAge is how long the list of calls is reused before it is fetched again.
+const callsMaxAge = time.Minute
+
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobPaused   = "paused"
+	jobCanceled = "canceled"
+	jobDone     = "done"
+	jobFailed   = "failed"
+)
+
+var (
+	errJobPaused   = errors.New("paused")
+	errJobCanceled = errors.New("canceled")
+)
+
+// job is a download requested through the API.
+type job struct {
+	LiveId     int       `json:"liveId"`
+	State      string    `json:"state"`
+	Size       int64     `json:"size,omitempty"`
+	Downloaded int64     `json:"downloaded"`
+	Speed      float64   `json:"speed"`         // bytes per second
+	ETA        float64   `json:"eta,omitempty"` // seconds
+	Error      string    `json:"error,omitempty"`
+	Queued     time.Time `json:"queued"`
+	Started    time.Time `json:"started,omitzero"`
+	Finished   time.Time `json:"finished,omitzero"`
+
+	bar    *mpb.Bar
+	wrote  bool // the download began writing the file, which is partial until it is done
+	cancel context.CancelCauseFunc
+	last   int64 // bytes at the previous speed sample, -1 before the first
+}
+
+// server runs the downloads requested through the HTTP API on one worker pool.
+type server struct {
+	d    *downloader
+	pool *workerPool[*job, bool]
+	p    *mpb.Progress
+
+	mu   sync.Mutex
+	jobs map[int]*job
+
+	listMu  sync.Mutex // held while listing, which can take a while
+	calls   map[int]map[string]any
+	liveIds []int
+	listed  time.Time
+}
+
+// serveCommand runs a local HTTP API and dashboard through which calls can be
+// listed, downloaded, paused and canceled.
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	config := addDownloadFlags(flags)
+	listen := flags.String("listen", "127.0.0.1:8080", "Address of the API and dashboard")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: phoning-downloader serve [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	cfg := config()
+	closeLog, err := setupLogging(cfg.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	if err := cfg.validate(); err != nil {
+		fatal(err.Error())
+	}
+	limiter, err := cfg.rateLimiter()
+	if err != nil {
+		fatal(err.Error())
+	}
+	disk, err := cfg.diskLedger()
+	if err != nil {
+		fatal(err.Error())
+	}
+	clients, err := newHTTPClients(cfg.Transport)
+	if err != nil {
+		fatal("Invalid connection settings", "err", err)
+	}
+	fileCfg, err := loadConfig(cfg.ConfigFile)
+	if err != nil {
+		fatal("Error loading config", "err", err)
+	}
+	hooks, err := newHooks(fileCfg.Hooks, clients.API)
+	if err != nil {
+		fatal("Invalid hook", "err", err)
+	}
+	uploads, err := newUploads(fileCfg.Uploads, clients.Download)
+	if err != nil {
+		fatal("Invalid upload", "err", err)
+	}
+	defer closeUploads(uploads)
+	s, err := newSession(clients)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		fatal("Failed to create Downloads directory", "err", err)
+	}
+	library, err := loadLibraryIndex(cfg.OutputDir)
+	if err != nil {
+		fatal("Error loading library index", "err", err)
+	}
+	d := &downloader{config: cfg, session: s, library: library, manifest: newManifest(), limiter: limiter, disk: disk, hooks: hooks, store: &localStorage{dir: cfg.OutputDir}, uploads: uploads, quiet: true}
+	if !cfg.DisableHash {
+		if d.manifest, err = openManifest(context.Background(), clients.API, cfg.ManifestSource, cfg.ManifestKey); err != nil {
+			fatal("Error loading hash file", "err", err)
+		}
+	}
+	if cfg.Adaptive {
+		d.controller = newAdaptiveController(cfg.Concurrency, cfg.Chunks)
+		go d.controller.Run(context.Background())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d.startUploads(ctx)
+	srv := &server{d: d, jobs: make(map[int]*job), p: mpb.New(mpb.WithOutput(nil), mpb.PopCompletedMode())}
+	srv.pool = newWorkerPool(ctx, srv.run, cfg.Concurrency, nil)
+	go srv.sample(ctx, time.Second)
+
+	stats.watchDisk(cfg.OutputDir)
+	if cfg.Metrics != "" {
+		metricsServer, err := serveMetrics(cfg.Metrics)
+		if err != nil {
+			fatal(err.Error())
+		}
+		defer metricsServer.Close()
+	}
+	mux := http.NewServeMux()
+	srv.routes(mux)
+	handleMetrics(mux)
+	if limiter != nil {
+		handleRateControl(mux, limiter)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal("Error listening", "addr", *listen, "err", err)
+	}
+	httpServer := &http.Server{Handler: allowedHost(*listen, sameOrigin(mux)), ReadHeaderTimeout: 5 * time.Second}
+	go httpServer.Serve(listener)
+	slog.Info("Serving API and dashboard", "url", "http://"+listener.Addr().String())
+
+	<-ctx.Done()
+	slog.Info("Shutting down, running downloads keep a checkpoint to resume from")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpServer.Shutdown(shutdownCtx)
+	srv.pool.Close()
+	srv.pool.Wait()
+	d.waitUploads()
+	if err := library.save(); err != nil {
+		slog.Warn("Could not save library index", "err", err)
+	}
+	hooks.wait()
+}
+
+func (s *server) routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+	mux.HandleFunc("GET /api/calls", s.handleCalls)
+	mux.HandleFunc("GET /api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.snapshot())
+	})
+	mux.HandleFunc("POST /api/jobs", s.handleEnqueue)
+	mux.HandleFunc("POST /api/jobs/{id}/pause", s.handleJob(s.pause))
+	mux.HandleFunc("POST /api/jobs/{id}/resume", s.handleJob(s.resume))
+	mux.HandleFunc("POST /api/jobs/{id}/cancel", s.handleJob(s.cancel))
+	mux.HandleFunc("GET /api/workers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]int{"workers": s.pool.Size(), "pending": s.pool.Pending()})
+	})
+	mux.HandleFunc("PUT /api/workers", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n < 1 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+		s.pool.Resize(n)
+		writeJSON(w, http.StatusOK, map[string]int{"workers": s.pool.Size(), "pending": s.pool.Pending()})
+	})
+}
+
+// callStatus is a listed call together with what the output directory and the
+// job queue know about it.
+type callStatus struct {
+	LiveId int    `json:"liveId"`
+	Status string `json:"status"` // downloaded, partial or missing
+	Job    *job   `json:"job,omitempty"`
+}
+
+func (s *server) handleCalls(w http.ResponseWriter, r *http.Request) {
+	liveIds, _, err := s.listCalls(r.URL.Query().Has("refresh"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	jobs := make(map[int]*job)
+	for _, j := range s.snapshot() {
+		jobs[j.LiveId] = j
+	}
+	statuses := make([]callStatus, 0, len(liveIds))
+	for _, liveId := range liveIds {
+		liveIdStr := strconv.Itoa(liveId)
+		status := callStatus{LiveId: liveId, Status: "missing", Job: jobs[liveId]}
+		switch {
+		case s.d.library.has(liveIdStr):
+			status.Status = "downloaded"
+		case hasCheckpoint(filepath.Join(s.d.config.OutputDir, liveIdStr+".mp4")):
+			status.Status = "partial"
+		}
+		statuses = append(statuses, status)
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// listCalls returns the calls, fetching them again when they are older than
+// callsMaxAge or refresh is set.
+func (s *server) listCalls(refresh bool) ([]int, map[int]map[string]any, error) {
+	s.listMu.Lock()
+	defer s.listMu.Unlock()
+	if refresh || time.Since(s.listed) > callsMaxAge {
+		liveIds, calls, err := s.d.session.fetchCalls()
+		if err != nil {
+			return nil, nil, fmt.Errorf("listing calls: %w", err)
+		}
+		s.liveIds, s.calls, s.listed = liveIds, calls, time.Now()
+	}
+	return s.liveIds, s.calls, nil
+}
+
+func (s *server) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Ids []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Ids) == 0 {
+		http.Error(w, `expected {"ids": [...]}`, http.StatusBadRequest)
+		return
+	}
+	liveIds, _, err := s.listCalls(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if slices.ContainsFunc(body.Ids, func(id int) bool { return !slices.Contains(liveIds, id) }) {
+		// the call may be newer than the list
+		if liveIds, _, err = s.listCalls(true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	var result struct {
+		Queued  []int `json:"queued"`
+		Skipped []int `json:"skipped"` // already downloaded or queued
+		Unknown []int `json:"unknown"`
+	}
+	for _, liveId := range body.Ids {
+		switch {
+		case !slices.Contains(liveIds, liveId):
+			result.Unknown = append(result.Unknown, liveId)
+		case s.d.library.has(strconv.Itoa(liveId)) || !s.enqueue(liveId):
+			result.Skipped = append(result.Skipped, liveId)
+		default:
+			result.Queued = append(result.Queued, liveId)
+		}
+	}
+	writeJSON(w, http.StatusAccepted, result)
+}
+
+// enqueue queues a download of a call unless one is already queued or running.
+func (s *server) enqueue(liveId int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[liveId]; ok && (j.State == jobQueued || j.State == jobRunning) {
+		return false
+	}
+	j := &job{LiveId: liveId, State: jobQueued, Queued: time.Now()}
+	s.jobs[liveId] = j
+	s.pool.Submit(j)
+	return true
+}
+
+// handleJob looks up the job of the request and applies action to it.
+func (s *server) handleJob(action func(*job) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		liveId, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid live ID", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		j, ok := s.jobs[liveId]
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, "no download for this live ID", http.StatusNotFound)
+			return
+		}
+		if err := action(j); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.snapshotJob(j))
+	}
+}
+
+// pause stops a download, keeping what was downloaded so far.
+func (s *server) pause(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch j.State {
+	case jobQueued:
+		j.State = jobPaused
+	case jobRunning:
+		j.cancel(errJobPaused)
+	default:
+		return fmt.Errorf("download is %s", j.State)
+	}
+	return nil
+}
+
+// resume queues a paused or failed download again. It continues from its
+// checkpoint if it has one.
+func (s *server) resume(j *job) error {
+	s.mu.Lock()
+	state := j.State
+	s.mu.Unlock()
+	if state != jobPaused && state != jobFailed {
+		return fmt.Errorf("download is %s", state)
+	}
+	s.enqueue(j.LiveId)
+	return nil
+}
+
+// cancel stops a download and deletes the partial file.
+func (s *server) cancel(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch j.State {
+	case jobRunning:
+		// the partial file is deleted once the download has stopped
+		j.cancel(errJobCanceled)
+	case jobQueued, jobPaused, jobFailed:
+		j.State = jobCanceled
+		s.removePartial(j)
+	default:
+		return fmt.Errorf("download is %s", j.State)
+	}
+	return nil
+}
+
+// removePartial deletes the file of a canceled download. Downloads in a single
+// stream keep no checkpoint, so the file goes whenever the job began writing it.
+// s.mu must be held.
+func (s *server) removePartial(j *job) {
+	path := filepath.Join(s.d.config.OutputDir, strconv.Itoa(j.LiveId)+".mp4")
+	if j.wrote || hasCheckpoint(path) {
+		os.Remove(path)
+		removeCheckpoint(path)
+	}
+}
+
+// run downloads the call of a job. It is run by the worker pool and never
+// fails, so that one failed download does not stop the others.
+func (s *server) run(j *job, ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	if j.State != jobQueued {
+		// paused or canceled while waiting
+		s.mu.Unlock()
+		return false, nil
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	j.State, j.Started, j.cancel, j.Error = jobRunning, time.Now(), cancel, ""
+	s.mu.Unlock()
+
+	err := s.download(ctx, j)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.Finished = time.Now()
+	j.Speed, j.ETA = 0, 0
+	if j.bar != nil {
+		j.Downloaded = j.bar.Current()
+		j.bar = nil
+	}
+	cause := context.Cause(ctx)
+	switch {
+	case err == nil:
+		j.State = jobDone
+		j.Downloaded = j.Size
+	case errors.Is(cause, errJobCanceled):
+		j.State = jobCanceled
+		s.removePartial(j)
+	case errors.Is(cause, errJobPaused) || ctx.Err() != nil:
+		j.State = jobPaused
+	default:
+		j.State = jobFailed
+		j.Error = err.Error()
+		slog.Error("Download failed", "liveId", j.LiveId, "err", err)
+		s.d.hooks.fire(hookEvent{Event: eventRunFailed, LiveId: j.LiveId, Error: err.Error()})
+	}
+	if err := s.d.library.save(); err != nil {
+		slog.Warn("Could not save library index", "err", err)
+	}
+	return err == nil, nil
+}
+
+func (s *server) download(ctx context.Context, j *job) error {
+	size, err := s.d.session.fetchSize(ctx, j.LiveId)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("live ID %d has an invalid size %d", j.LiveId, size)
+	}
+	s.mu.Lock()
+	j.Size = size
+	s.mu.Unlock()
+
+	liveIdStr := strconv.Itoa(j.LiveId)
+	path := filepath.Join(s.d.config.OutputDir, liveIdStr+".mp4")
+	if entry, ok := s.d.manifest.Calls[liveIdStr]; ok && !s.d.config.DisableHash && !hasCheckpoint(path) {
+		// an existing file is kept if it matches, and quarantined otherwise
+		if _, err := os.Stat(path); err == nil {
+			_, mismatch, err := s.d.library.verifyFile(path, liveIdStr, entry, true)
+			if err != nil {
+				return fmt.Errorf("error calculating hash for live ID %d: %v", j.LiveId, err)
+			}
+			if mismatch == nil {
+				return nil
+			}
+			if _, err := quarantineFile(s.d.config.OutputDir, newQuarantineRecord(j.LiveId, entry, s.d.library.recorded(liveIdStr), mismatch)); err != nil {
+				return fmt.Errorf("error quarantining file for live ID %d: %v", j.LiveId, err)
+			}
+			s.d.library.forget(liveIdStr)
+			s.d.hooks.fire(hookEvent{Event: eventHashMismatch, LiveId: j.LiveId, File: path, Error: mismatch.Error()})
+		}
+	}
+	return s.d.downloadCall(ctx, j.LiveId, size, func() *mpb.Bar {
+		bar := newFileBar(s.p, liveIdStr, size)
+		s.mu.Lock()
+		j.bar, j.last, j.wrote = bar, -1, true
+		s.mu.Unlock()
+		return bar
+	})
+}
+
+// sample updates the speed and remaining time of running downloads every interval.
+func (s *server) sample(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		for _, j := range s.jobs {
+			if j.State != jobRunning || j.bar == nil {
+				continue
+			}
+			current := j.bar.Current()
+			if j.last < 0 {
+				// the first sample includes what a checkpoint resumed from
+				j.Downloaded, j.last = current, current
+				continue
+			}
+			// smoothed like the speed of the progress bars
+			speed := float64(current-j.last) / interval.Seconds()
+			j.Speed = 0.7*j.Speed + 0.3*speed
+			j.Downloaded, j.last = current, current
+			if j.Speed > 0 {
+				j.ETA = float64(j.Size-current) / j.Speed
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// snapshot returns copies of all jobs, most recently queued first.
+func (s *server) snapshot() []*job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		c := *j
+		jobs = append(jobs, &c)
+	}
+	slices.SortFunc(jobs, func(a, b *job) int {
+		return b.Queued.Compare(a.Queued)
+	})
+	return jobs
+}
+
+func (s *server) snapshotJob(j *job) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *j
+	return &c
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// allowedHost rejects requests for a Host other than the listen address,
+// localhost or an IP address. A page on another site that rebinds its own name
+// to this address then cannot reach the API, as the browser sends that name.
+func allowedHost(listen string, h http.Handler) http.Handler {
+	listenHost, _, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		host = strings.Trim(host, "[]")
+		if !strings.EqualFold(host, "localhost") && !strings.EqualFold(host, listenHost) && net.ParseIP(host) == nil {
+			http.Error(w, "unknown host", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin rejects requests that change something when a browser reports
+// they come from another site, so other web pages cannot control downloads.
+func sameOrigin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
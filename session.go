@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+// session is an authenticated connection to the Phoning API.
+type session struct {
+	clients     httpClients
+	apiKey      string
+	accessToken string
+}
+
+// newSession loads the configuration from the .env file, generates an access
+// token if there is none yet and checks that the API can be reached.
+func newSession(clients httpClients) (*session, error) {
+	err := godotenv.Load()
+	if err != nil {
+		return nil, errors.New("error loading .env file")
+	}
+	access_token := os.Getenv("ACCESS_TOKEN")
+	generatingAccount := false
+	if access_token == "" {
+		generatingAccount = true
+		slog.Info("Access token not found, generating one")
+		body, err := register(clients.API)
+		if err != nil {
+			return nil, err
+		}
+		email := body["email"]
+		password := body["password"]
+		if email == "" || password == "" {
+			return nil, errors.New("email or password not found in registration response")
+		}
+		respBody, err := getToken(clients.API, email, password)
+		if err != nil {
+			return nil, err
+		}
+		decodedResponse := make(map[string]any)
+		if err := json.Unmarshal(respBody, &decodedResponse); err != nil {
+			return nil, fmt.Errorf("error decoding response: %v", err)
+		}
+		accessToken, ok := decodedResponse["accessToken"].(string)
+		if !ok {
+			return nil, errors.New("access token not found in response")
+		}
+		appendEnv("ACCESS_TOKEN", accessToken)
+		slog.Info("Access token fetched")
+	}
+	godotenv.Load()
+	api_key := os.Getenv("API_KEY")
+	access_token = os.Getenv("ACCESS_TOKEN")
+	slog.Debug("Checked configuration", "apiKey", api_key != "", "accessToken", access_token != "")
+	if api_key == "" {
+		slog.Error("API key not found in the .env file")
+	}
+	if access_token == "" {
+		slog.Error("Access token not found in the .env file")
+	}
+	if api_key == "" || access_token == "" {
+		return nil, errors.New("please check your configurations in the .env file")
+	}
+	if generatingAccount {
+		_, err := phoning(clients.API, "POST", api_key, "", "/fan/v1.0/login", map[string]string{
+			"wevAccessToken": access_token,
+			"tokenType": "APNS",
+			"deviceToken": "",
+		})
+		if err != nil {
+			return nil, errors.New("you do not have access to the Phoning API, please check your network connection and API key")
+		}
+	}
+	_, err = phoning(clients.API, "GET", api_key, access_token, "/fan/v1.0/users/me")
+	if err != nil {
+		slog.Error("You do not have access to the Phoning API. Please check your network connection, API key, and access token.", "err", err)
+	} else {
+		slog.Info("You have access to the Phoning API")
+	}
+	return &session{clients: clients, apiKey: api_key, accessToken: access_token}, nil
+}
+
+// fetchCalls lists every call, following the API cursors. liveIds keeps the order of the API.
+func (s *session) fetchCalls() (liveIds []int, calls map[int]map[string]any, err error) {
+	var callsData []any = make([]any, 0)
+	nextCursor := ""
+	cnt := 0
+	for {
+		cnt++
+		if cnt > 10 {
+			return nil, nil, errors.New("too many iterations, stopping to prevent infinite loop")
+		}
+		params := map[string]string{"limit": "100"}
+		if nextCursor != "" {
+			params["cursor"] = nextCursor
+		}
+		page, err := phoning(s.clients.API, "GET", s.apiKey, s.accessToken, "/fan/v1.0/lives", params)
+		if err != nil {
+			return nil, nil, err
+		}
+		pageData, ok := page["data"].([]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("unexpected data format: %T", page["data"])
+		}
+		callsData = append(callsData, pageData...)
+		cursors, ok := page["cursors"].(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("unexpected cursors format: %T", page["cursors"])
+		}
+		next, ok := cursors["next"].(string)
+		if !ok {
+			break
+		}
+		nextCursor = next
+	}
+	liveIds = make([]int, len(callsData))
+	calls = make(map[int]map[string]any, len(callsData))
+	for i, call := range callsData {
+		callMap, ok := call.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("unexpected call format: %T", call)
+		}
+		liveId, ok := callMap["liveId"].(float64)
+		if !ok {
+			return nil, nil, fmt.Errorf("live ID not found in call: %v", callMap)
+		}
+		calls[int(liveId)] = callMap
+		liveIds[i] = int(liveId)
+	}
+	return liveIds, calls, nil
+}
+
+// videoURL returns the download URL of a call.
+func (s *session) videoURL(liveId int) (string, error) {
+	pnxml, err := getPNXML(s.clients.API, s.apiKey, s.accessToken, liveId)
+	if err != nil {
+		return "", fmt.Errorf("error getting PNXML for live ID %d: %v", liveId, err)
+	}
+	url, ok := pnxml["url"].(string)
+	if !ok {
+		return "", fmt.Errorf("PNXML for live ID %d does not contain a valid URL", liveId)
+	}
+	return url, nil
+}
+
+// fetchSize returns the size of a call's video.
+func (s *session) fetchSize(ctx context.Context, liveId int) (int64, error) {
+	url, err := s.videoURL(liveId)
+	if err != nil {
+		return 0, err
+	}
+	headReq, _ := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	resp, err := s.clients.Download.Do(headReq)
+	if err != nil {
+		return 0, fmt.Errorf("HEAD request failed for live ID %d: %v", liveId, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD request failed for live ID %d: %s", liveId, resp.Status)
+	}
+	return resp.ContentLength, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// sftpTarget uploads to a directory of an SSH server. The connection is opened
+// on first use and again after it broke.
+type sftpTarget struct {
+	addr     string // host:port
+	dir      string
+	location string // sftp://user@host:port/dir, for the library index
+	config   *ssh.ClientConfig
+	key      string // private key file
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPTarget(u *url.URL, cfg uploadConfig) (*sftpTarget, error) {
+	username := cfg.Username
+	if username == "" && u.User != nil {
+		username = u.User.Username()
+	}
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("no username: %v", err)
+		}
+		username = current.Username
+	}
+	hostKeyCallback, err := sftpHostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t := &sftpTarget{
+		addr: u.Host,
+		dir:  u.Path,
+		key:  expandHome(cfg.PrivateKey),
+		config: &ssh.ClientConfig{
+			User:            username,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sftpDialTimeout,
+		},
+	}
+	if u.Port() == "" {
+		t.addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if t.dir == "" {
+		t.dir = "."
+	}
+	t.location = (&url.URL{Scheme: "sftp", User: url.User(username), Host: u.Host, Path: u.Path}).String()
+	if password := cfg.password(); password != "" {
+		t.config.Auth = append(t.config.Auth, ssh.Password(password))
+	}
+	if t.key == "" && os.Getenv("SSH_AUTH_SOCK") == "" && len(t.config.Auth) == 0 {
+		return nil, errors.New("no way to log in: set privateKey, a password or run ssh-agent")
+	}
+	return t, nil
+}
+
+// sftpHostKeyCallback checks the server key against the hostKey fingerprint,
+// or else the known_hosts file.
+func sftpHostKeyCallback(cfg uploadConfig) (ssh.HostKeyCallback, error) {
+	if cfg.HostKey != "" {
+		want := strings.TrimPrefix(cfg.HostKey, "SHA256:")
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); strings.TrimPrefix(got, "SHA256:") != want {
+				return fmt.Errorf("host key of %s is %s, expected SHA256:%s", hostname, got, want)
+			}
+			return nil
+		}, nil
+	}
+	file := expandHome(cfg.KnownHosts)
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no known_hosts file: %v", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %v (set hostKey to the fingerprint of the server instead)", err)
+	}
+	return callback, nil
+}
+
+func expandHome(p string) string {
+	if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return p
+}
+
+// connect returns the SFTP client, logging in if there is no connection.
+func (t *sftpTarget) connect() (*sftp.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+	config := *t.config
+	config.Auth = nil
+	if t.key != "" {
+		data, err := os.ReadFile(t.key)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v (keys with a passphrase have to be added to ssh-agent)", t.key, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if agentConn, err := net.Dial("unix", sock); err == nil {
+			defer agentConn.Close()
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+	config.Auth = append(config.Auth, t.config.Auth...)
+	conn, err := ssh.Dial("tcp", t.addr, &config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.conn, t.client = conn, client
+	return client, nil
+}
+
+// check drops the connection after an error that is not an answer of the
+// server, so the next operation connects again.
+func (t *sftpTarget) check(err error) error {
+	var status *sftp.StatusError
+	if err == nil || errors.As(err, &status) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	t.Close()
+	return err
+}
+
+func (t *sftpTarget) path(name string) string {
+	return path.Join(t.dir, name)
+}
+
+func (t *sftpTarget) Location(name string) string {
+	return t.location + "/" + name
+}
+
+func (t *sftpTarget) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client == nil {
+		return nil
+	}
+	t.client.Close()
+	err := t.conn.Close()
+	t.conn, t.client = nil, nil
+	return err
+}
+
+func (t *sftpTarget) Stat(ctx context.Context, name string) (storageObject, error) {
+	client, err := t.connect()
+	if err != nil {
+		return storageObject{}, err
+	}
+	info, err := client.Stat(t.path(name))
+	if err != nil {
+		return storageObject{}, t.check(err)
+	}
+	return storageObject{Name: name, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func (t *sftpTarget) WriteFrom(ctx context.Context, name string, offset int64, r io.Reader, size int64) error {
+	client, err := t.connect()
+	if err != nil {
+		return err
+	}
+	if err := client.MkdirAll(t.dir); err != nil {
+		return t.check(err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := client.OpenFile(t.path(name), flags)
+	if err != nil {
+		return t.check(err)
+	}
+	defer file.Close()
+	// the SFTP client does not take a context, closing the file stops the writes
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	defer stop()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := file.ReadFrom(r)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return t.check(err)
+	}
+	if n != size {
+		return fmt.Errorf("wrote %d bytes, expected %d", n, size)
+	}
+	return t.check(file.Close())
+}
+
+func (t *sftpTarget) Rename(ctx context.Context, from, to string) error {
+	client, err := t.connect()
+	if err != nil {
+		return err
+	}
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return t.check(client.PosixRename(t.path(from), t.path(to)))
+	}
+	// plain SFTP renames refuse to replace a file
+	if err := client.Remove(t.path(to)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return t.check(err)
+	}
+	return t.check(client.Rename(t.path(from), t.path(to)))
+}
+
+func (t *sftpTarget) Delete(ctx context.Context, name string) error {
+	client, err := t.connect()
+	if err != nil {
+		return err
+	}
+	return t.check(client.Remove(t.path(name)))
+}
+
+// SHA256 runs sha256sum on the server, which works where the account has a
+// shell and not only SFTP access.
+func (t *sftpTarget) SHA256(ctx context.Context, name string) (string, error) {
+	if _, err := t.connect(); err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn == nil {
+		return "", errors.New("not connected")
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+	out, err := session.Output("sha256sum -- " + shellQuote(t.path(name)))
+	if err != nil {
+		return "", fmt.Errorf("sha256sum: %v", err)
+	}
+	sum, _, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	if len(sum) != 64 {
+		return "", fmt.Errorf("unexpected sha256sum output %q", out)
+	}
+	return strings.ToLower(sum), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
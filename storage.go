@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+	"golang.org/x/sync/errgroup"
+)
+
+// storageObject describes a stored file.
+type storageObject struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// storage is where downloaded calls are kept: the output directory, or a bucket
+// of S3-compatible object storage. Names are slash-separated and relative to the
+// root of the storage.
+type storage interface {
+	// Fetch downloads url into the file name. check is called once the file is
+	// written and hashed, and its error is returned; object storage then drops
+	// the file, while a local file is kept so that it can be quarantined.
+	Fetch(ctx context.Context, url, name string, opts downloadOptions, bar *mpb.Bar, check func() error) error
+	// Stat returns an error matching fs.ErrNotExist if there is no such file.
+	Stat(ctx context.Context, name string) (storageObject, error)
+	// List returns the files directly in the root, not in folders below it.
+	List(ctx context.Context) ([]storageObject, error)
+	Rename(ctx context.Context, from, to string) error
+	Delete(ctx context.Context, name string) error
+	// Location is the path or URL of name, for logs and hooks.
+	Location(name string) string
+	String() string
+}
+
+// partStorage is storage that files are written to in numbered parts.
+type partStorage interface {
+	// Create starts writing a file of size bytes. Nothing appears under name
+	// before the writer is committed.
+	Create(ctx context.Context, name string, size int64) (storageWriter, error)
+}
+
+// storageWriter is a file being written. It receives the file in parts of
+// PartSize bytes, numbered from 1, of which only the last may be shorter.
+type storageWriter interface {
+	PartSize() int64
+	WritePart(ctx context.Context, number int, data []byte) error
+	// Commit makes the file visible under its name.
+	Commit(ctx context.Context) error
+	// Abort drops what has been written.
+	Abort(ctx context.Context) error
+}
+
+// newStorage returns the storage for the -storage flag: the output directory
+// when location is empty, or a bucket for s3://bucket/prefix.
+func newStorage(location, outputDir string, client *http.Client) (storage, error) {
+	if location == "" {
+		return &localStorage{dir: outputDir}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -storage: %v", err)
+	}
+	if u.Scheme != "s3" {
+		return nil, fmt.Errorf("invalid -storage %q, expected s3://bucket/prefix", location)
+	}
+	return newS3Storage(u, client)
+}
+
+// localStorage keeps files in a directory. Downloads are written in place and
+// resumed from their checkpoint after an interruption.
+type localStorage struct {
+	dir string
+}
+
+func (l *localStorage) String() string {
+	return l.dir
+}
+
+func (l *localStorage) Location(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(name))
+}
+
+// path resolves name below the directory, refusing names that leave it.
+func (l *localStorage) path(name string) (string, error) {
+	_, p, err := safeDestPath(l.Location(name), l.dir)
+	return p, err
+}
+
+func (l *localStorage) Fetch(ctx context.Context, url, name string, opts downloadOptions, bar *mpb.Bar, check func() error) error {
+	if err := DownloadVideo(ctx, url, l.Location(name), l.dir, opts, bar); err != nil {
+		return err
+	}
+	if check != nil {
+		return check()
+	}
+	return nil
+}
+
+func (l *localStorage) Stat(ctx context.Context, name string) (storageObject, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return storageObject{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return storageObject{}, err
+	}
+	return storageObject{Name: name, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func (l *localStorage) List(ctx context.Context) ([]storageObject, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var objects []storageObject
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, storageObject{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (l *localStorage) Rename(ctx context.Context, from, to string) error {
+	src, err := l.path(from)
+	if err != nil {
+		return err
+	}
+	dest, err := l.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(src, dest)
+}
+
+func (l *localStorage) Delete(ctx context.Context, name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// uploadVideo downloads `url` into the file name of store. The file is fetched
+// in parts, one range request each, that are written as soon as they are
+// complete; a part has to wait for the previous ones before it is hashed, so at
+// most opts.Chunks parts are held in memory. check is called once every part is
+// written and hashed; if it fails, e.g. because the hashes do not match the
+// manifest, the upload is dropped instead of completed. An interrupted upload
+// is dropped rather than resumed.
+func uploadVideo(ctx context.Context, url string, store partStorage, name string, opts downloadOptions, bar *mpb.Bar, check func() error) error {
+	length, supportRanges, err := probeVideo(ctx, url, opts)
+	if err != nil {
+		return err
+	}
+	if !supportRanges {
+		return errors.New("the server does not support range requests, which are needed to upload in parts")
+	}
+	w, err := store.Create(ctx, name, length)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", name, err)
+	}
+	err = writeParts(ctx, url, name, length, w, opts, bar)
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err != nil {
+		if abortErr := w.Abort(context.WithoutCancel(ctx)); abortErr != nil {
+			return fmt.Errorf("%w (aborting upload: %v)", err, abortErr)
+		}
+		return err
+	}
+	if err := w.Commit(ctx); err != nil {
+		return fmt.Errorf("completing %s: %w", name, err)
+	}
+	return nil
+}
+
+func writeParts(ctx context.Context, url, name string, length int64, w storageWriter, opts downloadOptions, bar *mpb.Bar) error {
+	partSize := w.PartSize()
+	concurrency := opts.Chunks
+	if opts.Adaptive != nil {
+		concurrency = opts.Adaptive.Chunks()
+	}
+	stats.activeDownloads.Add(1)
+	defer stats.activeDownloads.Add(-1)
+
+	parts := int((length + partSize - 1) / partSize)
+	// hashed[i] is closed once part i has gone into opts.Hash
+	hashed := make([]chan struct{}, parts)
+	for i := range hashed {
+		hashed[i] = make(chan struct{})
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(max(1, concurrency))
+	for i := range parts {
+		if egCtx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			start := int64(i) * partSize
+			end := min(start+partSize, length) - 1
+			buf := &partBuffer{name: name, start: start, data: make([]byte, end-start+1)}
+			if err := fetchChunk(egCtx, url, buf, newChunk(start, end), opts, bar); err != nil {
+				return err
+			}
+			if err := w.WritePart(egCtx, i+1, buf.data); err != nil {
+				return fmt.Errorf("writing part %d: %w", i+1, err)
+			}
+			if opts.Hash != nil && i > 0 {
+				select {
+				case <-hashed[i-1]:
+				case <-egCtx.Done():
+					return egCtx.Err()
+				}
+			}
+			if opts.Hash != nil {
+				opts.Hash.Write(buf.data)
+			}
+			close(hashed[i])
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// partBuffer holds one part of a file while it is downloaded.
+type partBuffer struct {
+	name  string
+	start int64
+	data  []byte
+}
+
+func (b *partBuffer) Name() string {
+	return b.name
+}
+
+func (b *partBuffer) WriteAt(p []byte, off int64) (int, error) {
+	off -= b.start
+	if off < 0 || off+int64(len(p)) > int64(len(b.data)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of the part", len(p), off+b.start)
+	}
+	return copy(b.data[off:], p), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+)
+
+func TestLocalStorage(t *testing.T) {
+	video := bytes.Repeat([]byte("phoning!"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(video))
+	}))
+	defer server.Close()
+	bar := mpb.New(mpb.WithOutput(nil)).New(0, mpb.NopStyle())
+	dir := t.TempDir()
+	store, err := newStorage("", dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := store.Fetch(ctx, server.URL, "169.mp4", downloadOptions{Chunks: 2}, bar, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "169.mp4")); !bytes.Equal(data, video) {
+		t.Error("downloaded file differs from the video")
+	}
+	// a failed check is returned, and the file is kept for the quarantine
+	mismatch := errors.New("sha256 does not match")
+	if err := store.Fetch(ctx, server.URL, "170.mp4", downloadOptions{Chunks: 2}, bar, func() error { return mismatch }); !errors.Is(err, mismatch) {
+		t.Errorf("err = %v, want the mismatch", err)
+	}
+	objects, err := store.List(ctx)
+	if err != nil || len(objects) != 2 || objects[0].Name != "169.mp4" || objects[0].Size != int64(len(video)) {
+		t.Errorf("List = %+v, %v", objects, err)
+	}
+
+	if err := store.Rename(ctx, "170.mp4", "old/170.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "170.mp4"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of the renamed file = %v", err)
+	}
+	if err := store.Delete(ctx, "old/170.mp4"); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.Stat(ctx, "../169.mp4"); err == nil {
+		t.Error("Stat outside of the directory succeeded")
+	}
+}
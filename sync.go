@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+const fetchConcurrency = 64
+
+// downloadConfig holds the settings shared by the download run and watch mode.
+type downloadConfig struct {
+	OutputDir      string
+	Concurrency    int
+	Chunks         int
+	DisableHash    bool
+	Adaptive       bool
+	LimitRate      string
+	LimitSchedule  string
+	LimitControl   string
+	MinFree        string
+	Metrics        string
+	ManifestSource string
+	ManifestKey    string
+	Unverified     string
+	Order          string
+	PurgeReplaced  bool
+	ConfigFile     string
+	Transport      transportConfig
+	Log            logConfig
+}
+
+// addDownloadFlags registers the download flags on flags. The returned function
+// collects their values after parsing.
+func addDownloadFlags(flags *flag.FlagSet) func() downloadConfig {
+	outputDir := flags.String("o", "Downloads", "Directory to save downloaded videos")
+	concurrency := flags.Int("c", 10, "Concurrent downloads")
+	chunk := flags.Int("d", 10, "Number of chunks to download in parallel")
+	disableHash := flags.Bool("f", false, "Do not check hash values (might get corrupted files)")
+	adaptive := flags.Bool("adaptive", false, "Tune concurrency from measured throughput, using -c and -d as upper limits")
+	transport := addTransportFlags(flags)
+	logging := addLogFlags(flags)
+	limitRate := flags.String("limit-rate", "0", "Total download bandwidth limit, e.g. 20M (0 for unlimited)")
+	limitSchedule := flags.String("limit-schedule", "", "Daily bandwidth windows overriding -limit-rate, e.g. \"09:00-18:00=5M\"")
+	limitControl := flags.String("limit-control", "", "Local address to adjust the bandwidth limit at runtime, e.g. 127.0.0.1:7070")
+	minFree := flags.String("min-free", "0", "Free space to keep in the output directory, e.g. 5G; downloads wait while there is less")
+	metrics := flags.String("metrics", "", "Local address to serve Prometheus metrics at /metrics, e.g. 127.0.0.1:9090")
+	manifestSource := flags.String("manifest", "", "Hash file path or HTTPS URL (default is the hash file built into the binary)")
+	manifestKey := flags.String("manifest-key", manifestPublicKey, "Base64 ed25519 public key for remote hash files")
+	unverifiedPolicy := flags.String("unverified", "download", "What to do with calls missing from the hash file: download (without verification) or skip")
+	order := flags.String("order", "newest", "Download order: "+strings.Join(downloadOrders, ", ")+" (newest and oldest go by live ID, not by the time of the call)")
+	purgeReplaced := flags.Bool("purge-replaced", false, "Delete a quarantined file once its replacement has been downloaded and verified")
+	configFile := flags.String("config", "", "JSON config file with a schedule and hooks")
+	return func() downloadConfig {
+		return downloadConfig{
+			OutputDir:      *outputDir,
+			Concurrency:    *concurrency,
+			Chunks:         *chunk,
+			DisableHash:    *disableHash,
+			Adaptive:       *adaptive,
+			LimitRate:      *limitRate,
+			LimitSchedule:  *limitSchedule,
+			LimitControl:   *limitControl,
+			MinFree:        *minFree,
+			Metrics:        *metrics,
+			ManifestSource: *manifestSource,
+			ManifestKey:    *manifestKey,
+			Unverified:     *unverifiedPolicy,
+			Order:          *order,
+			PurgeReplaced:  *purgeReplaced,
+			ConfigFile:     *configFile,
+			Transport:      transport(),
+			Log:            logging(),
+		}
+	}
+}
+
+func (c downloadConfig) validate() error {
+	if c.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if c.Chunks < 1 {
+		return errors.New("chunk size must be at least 1")
+	}
+	if c.Unverified != "download" && c.Unverified != "skip" {
+		return errors.New("-unverified must be either download or skip")
+	}
+	if !slices.Contains(downloadOrders, c.Order) {
+		return fmt.Errorf("-order must be one of %s", strings.Join(downloadOrders, ", "))
+	}
+	return nil
+}
+
+// rateLimiter returns the limiter configured by the -limit flags, or nil if
+// downloads are not limited.
+func (c downloadConfig) rateLimiter() (*rateLimiter, error) {
+	rate, err := parseByteSize(c.LimitRate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -limit-rate: %v", err)
+	}
+	schedule, err := parseRateSchedule(c.LimitSchedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -limit-schedule: %v", err)
+	}
+	if rate > 0 || len(schedule) > 0 || c.LimitControl != "" {
+		return newRateLimiter(rate, schedule), nil
+	}
+	return nil, nil
+}
+
+// diskLedger returns the ledger that downloads into the output directory
+// reserve their space with, keeping -min-free free.
+func (c downloadConfig) diskLedger() (*diskLedger, error) {
+	minFree, err := parseByteSize(c.MinFree)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -min-free: %v", err)
+	}
+	return newDiskLedger(c.OutputDir, minFree), nil
+}
+
+// downloader downloads calls into the output directory, verifying them against
+// the manifest and recording them in the library index.
+type downloader struct {
+	config     downloadConfig
+	session    *session
+	library    *libraryIndex
+	manifest   *manifest
+	limiter    *rateLimiter
+	disk       *diskLedger
+	controller *adaptiveController
+	hooks      *hooks
+	report     *runReport
+	store      storage      // where calls are downloaded to, the output directory unless -storage is given
+	uploads    []*upload    // servers verified calls are copied to after downloading
+	upQueue    *uploadQueue // uploads of the calls downloaded since startUploads
+	listed     map[int]bool // calls seen by the previous watch cycle
+	quiet      bool         // log instead of drawing progress bars
+}
+
+// progress returns the container for progress bars, which are not drawn when
+// quiet, and a function that waits for its bars to finish.
+func (d *downloader) progress() (*mpb.Progress, func()) {
+	if d.quiet {
+		p := mpb.New(mpb.WithOutput(nil))
+		return p, p.Wait
+	}
+	p := mpb.New(mpb.WithWidth(64), mpb.PopCompletedMode())
+	restore := logAbove(p)
+	return p, func() {
+		p.Wait()
+		restore()
+	}
+}
+
+// fetchSizes requests the size of every call.
+func (d *downloader) fetchSizes(liveIds []int) (map[int]int64, error) {
+	if len(liveIds) == 0 {
+		// a bar without a total would never finish
+		return map[int]int64{}, nil
+	}
+	p, wait := d.progress()
+	bar := p.New(int64(len(liveIds)),
+		mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
+		mpb.PrependDecorators(
+			decor.Name("Fetching...", decor.WC{W: 5, C: decor.DindentRight}),
+			decor.Current(0, "(%d", decor.WC{W: 5}),
+			decor.Total(0, "/%d)", decor.WC{W: 5, C: decor.DindentRight}),
+		),
+		mpb.AppendDecorators(
+			decor.NewPercentage("%.2f", decor.WC{W: 7}),
+		),
+	)
+	fetchFunction := func(liveId int, ctx context.Context) (int64, error) {
+		length, err := d.session.fetchSize(ctx, liveId)
+		if err != nil {
+			return 0, err
+		}
+		bar.IncrInt64(1)
+		return length, nil
+	}
+	sizes, err := runPool(context.Background(), fetchFunction, liveIds, fetchConcurrency, nil)
+	if err != nil {
+		bar.Abort(false)
+	}
+	wait()
+	if err != nil {
+		return nil, err
+	}
+	for liveId, size := range sizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("live ID %d has an invalid size %d", liveId, size)
+		}
+	}
+	return sizes, nil
+}
+
+// downloadCalls downloads the given calls in the configured order and returns
+// how many were downloaded before the first error. When ctx ends, interrupted
+// downloads keep a checkpoint to resume from.
+func (d *downloader) downloadCalls(ctx context.Context, liveIds []int, sizes map[int]int64) (int, error) {
+	if len(liveIds) == 0 {
+		return 0, nil
+	}
+	compare, err := callOrder(d.config.Order, sizes)
+	if err != nil {
+		return 0, err
+	}
+	liveIds = slices.Clone(liveIds)
+	slices.SortStableFunc(liveIds, compare)
+	rank := make(map[int]int, len(liveIds))
+	var totalSize int64
+	for i, liveId := range liveIds {
+		rank[liveId] = i
+		totalSize += sizes[liveId]
+	}
+
+	d.report.startDownloads(d.config.Order, liveIds)
+	p, wait := d.progress()
+	totalbar := p.New(totalSize,
+		mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
+		mpb.BarPriority(math.MaxInt),
+		mpb.PrependDecorators(
+			decor.Name("", decor.WC{W: 5, C: decor.DindentRight}),
+			decor.Current(decor.SizeB1024(0), "% .1f", decor.WC{W: 11}),
+			decor.TotalKibiByte(" / % .1f", decor.WC{W: 14, C: decor.DindentRight}),
+			decor.AverageSpeed(decor.SizeB1024(0), "% .1f", decor.WC{W: 13}),
+			decor.Elapsed(decor.ET_STYLE_MMSS, decor.WC{W: 10}),
+			decor.Name(" ETA: ", decor.WC{W: 6}),
+			decor.AverageETA(decor.ET_STYLE_MMSS, decor.WC{W: 9, C: decor.DindentRight}),
+		),
+		mpb.AppendDecorators(
+			decor.NewPercentage("%.2f", decor.WC{W: 7}),
+		),
+	)
+	countbar := p.New(int64(len(liveIds)),
+		mpb.BarStyle().Padding(" ").Lbound(" ").Filler(" ").Tip(" ").Lbound(" ").Rbound(" "),
+		mpb.BarPriority(math.MaxInt - 1),
+		mpb.PrependDecorators(
+			decor.Name(color.CyanString("Total"), decor.WC{W: 5, C: decor.DindentRight}),
+			decor.Current(0, "(%d", decor.WC{W: 5}),
+			decor.Total(0, "/%d)", decor.WC{W: 5, C: decor.DindentRight}),
+		),
+	)
+	var downloaded atomic.Int64
+	downloadFunction := func(liveId int, ctx context.Context) (bool, error) {
+		err := d.downloadCall(ctx, liveId, sizes[liveId], func() *mpb.Bar {
+			// keep the bars of running downloads in download order
+			bar := newFileBar(p, strconv.Itoa(liveId), sizes[liveId], mpb.BarPriority(rank[liveId]))
+			hookTotalProgress(bar, totalbar)
+			return bar
+		})
+		if err != nil {
+			return false, err
+		}
+		countbar.IncrInt64(1)
+		downloaded.Add(1)
+		return true, nil
+	}
+	_, err = runPool(ctx, downloadFunction, liveIds, d.config.Concurrency, compare)
+	if err != nil {
+		totalbar.Abort(false)
+		countbar.Abort(false)
+	}
+	wait()
+	if saveErr := d.library.save(); saveErr != nil {
+		slog.Warn("Could not save library index", "err", saveErr)
+	}
+	return int(downloaded.Load()), err
+}
+
+// local reports whether calls are downloaded to the output directory, which the
+// library index, checkpoints, the disk ledger and the quarantine folder cover.
+func (d *downloader) local() bool {
+	_, ok := d.store.(*localStorage)
+	return ok
+}
+
+// downloadCall downloads a call of size bytes into the output directory, verifies
+// it against the manifest and records it in the library index. newBar is called
+// once the download starts; the bar is dropped if the download fails.
+func (d *downloader) downloadCall(ctx context.Context, liveId int, size int64, newBar func() *mpb.Bar) (err error) {
+	liveIdStr := strconv.Itoa(liveId)
+	entry, verify := d.manifest.Calls[liveIdStr]
+	verify = verify && !d.config.DisableHash
+	call := callReport{LiveId: liveId, Size: size, Result: "downloaded"}
+	var retries atomic.Int64
+	var started time.Time
+	defer func() {
+		if !started.IsZero() {
+			call.Duration = time.Since(started).Seconds()
+		}
+		call.Retries = retries.Load()
+		if err != nil {
+			call.Result, call.Error = "failed", err.Error()
+			if ctx.Err() != nil {
+				call.Result = "interrupted"
+			}
+		}
+		d.report.addCall(call)
+	}()
+	downloadFilePath := filepath.Join(d.config.OutputDir, liveIdStr+".mp4")
+	if d.local() {
+		// reserved before the adaptive slot, so a download waiting for space does not hold one
+		release, err := d.disk.reserve(ctx, downloadFilePath, size)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if err := d.controller.Acquire(ctx); err != nil {
+		return err
+	}
+	defer d.controller.Release()
+	url, err := d.session.videoURL(liveId)
+	if err != nil {
+		return err
+	}
+	opts := downloadOptions{Chunks: d.config.Chunks, Limiter: d.limiter, Adaptive: d.controller, Client: d.session.clients.Download, Retries: &retries}
+	if verify {
+		opts.Hash, err = newHashSet(entry.algorithms()...)
+		if err != nil {
+			return err
+		}
+	}
+	bar := newBar()
+	started = time.Now()
+	var mismatch error
+	downloadFilePath = d.store.Location(liveIdStr + ".mp4")
+	err = d.store.Fetch(ctx, url, liveIdStr+".mp4", opts, bar, func() error {
+		// checked before an upload is completed, so a mismatching file never appears in a bucket
+		if verify {
+			mismatch = entry.verify(size, opts.Hash.Sums())
+		}
+		return mismatch
+	})
+	if err != nil && mismatch == nil {
+		bar.Abort(true)
+		return fmt.Errorf("error downloading live ID %d: %v", liveId, err)
+	}
+	var sums map[string]string
+	call.Hash = hashUnverified
+	if verify {
+		sums = opts.Hash.Sums()
+		stats.observeVerification(mismatch, nil)
+		call.Hash = "ok"
+		if mismatch != nil {
+			call.Hash = "mismatch"
+			d.hooks.fire(hookEvent{Event: eventHashMismatch, LiveId: liveId, Size: size, File: downloadFilePath, Error: mismatch.Error()})
+			if !d.local() {
+				slog.Warn("Dropped upload with hash mismatch", "liveId", liveId)
+			}
+			return fmt.Errorf("live ID %d: %v", liveId, mismatch)
+		}
+	}
+	if !d.local() {
+		// the library index and the quarantine folder only cover the output directory
+		slog.Info("Uploaded call", "liveId", liveId, "size", size, "verified", verify, "object", downloadFilePath)
+		d.hooks.fire(hookEvent{Event: eventCallDownloaded, LiveId: liveId, Size: size, File: downloadFilePath})
+		return nil
+	}
+	if err := d.library.recordFile(downloadFilePath, liveIdStr, sums); err != nil {
+		return err
+	}
+	slog.Info("Downloaded call", "liveId", liveId, "size", size, "verified", verify, "file", downloadFilePath)
+	d.hooks.fire(hookEvent{Event: eventCallDownloaded, LiveId: liveId, Size: size, File: downloadFilePath})
+	if verify && d.config.PurgeReplaced {
+		if _, err := purgeQuarantined(d.config.OutputDir, liveId); err != nil {
+			slog.Warn("Could not delete quarantined copy", "liveId", liveId, "err", err)
+		}
+	}
+	if verify {
+		d.queueUpload(liveId)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const apiTimeout = 10 * time.Second
+
+// transportConfig holds the connection settings shared by every HTTP request.
+type transportConfig struct {
+	Proxy           string // http(s):// or socks5:// URL, empty to use the environment
+	ConnectTimeout  time.Duration
+	HeaderTimeout   time.Duration
+	IdleTimeout     time.Duration
+	MaxConnsPerHost int // 0 for no limit
+	MaxIdleConns    int // idle connections kept per host
+	HTTP2           bool
+}
+
+// httpClients share one transport. API calls are bounded by apiTimeout while
+// downloads only rely on the transport timeouts, since they can take hours.
+type httpClients struct {
+	API      *http.Client
+	Download *http.Client
+}
+
+// addTransportFlags registers the connection flags on flags. The returned
+// function reads them back once the flags are parsed.
+func addTransportFlags(flags *flag.FlagSet) func() transportConfig {
+	proxy := flags.String("proxy", "", "HTTP or SOCKS5 proxy URL, e.g. socks5://127.0.0.1:1080 (default from HTTPS_PROXY)")
+	connectTimeout := flags.Duration("connect-timeout", 30*time.Second, "Timeout for establishing connections")
+	headerTimeout := flags.Duration("header-timeout", 30*time.Second, "Timeout for waiting on response headers")
+	idleTimeout := flags.Duration("idle-timeout", 90*time.Second, "How long idle connections are kept open")
+	maxConnsPerHost := flags.Int("max-conns-per-host", 0, "Maximum connections per host (0 for no limit)")
+	maxIdleConns := flags.Int("max-idle-conns", 32, "Maximum idle connections kept per host")
+	http2 := flags.Bool("http2", true, "Allow HTTP/2")
+	return func() transportConfig {
+		return transportConfig{
+			Proxy:           *proxy,
+			ConnectTimeout:  *connectTimeout,
+			HeaderTimeout:   *headerTimeout,
+			IdleTimeout:     *idleTimeout,
+			MaxConnsPerHost: *maxConnsPerHost,
+			MaxIdleConns:    *maxIdleConns,
+			HTTP2:           *http2,
+		}
+	}
+}
+
+func newTransport(cfg transportConfig) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(cfg.HTTP2)
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.HeaderTimeout,
+		IdleConnTimeout:       cfg.IdleTimeout,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConns,
+		ExpectContinueTimeout: 1 * time.Second,
+		Protocols:             protocols,
+	}, nil
+}
+
+func newHTTPClients(cfg transportConfig) (httpClients, error) {
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return httpClients{}, err
+	}
+	return httpClients{
+		API:      &http.Client{Transport: transport, Timeout: apiTimeout},
+		Download: &http.Client{Transport: transport},
+	}, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uploadConfig is an entry of the "uploads" list of the config file: a server
+// that verified calls are copied to, e.g.
+//
+//	{"name": "nas", "url": "https://nas.local/dav/phoning/", "username": "me", "passwordEnv": "NAS_PASSWORD"}
+//	{"name": "backup", "url": "sftp://me@nas.local/volume1/phoning", "privateKey": "~/.ssh/id_ed25519", "deleteLocal": true}
+type uploadConfig struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`                   // http(s):// for WebDAV, sftp:// for SFTP
+	Username    string `json:"username,omitempty"`    // for SFTP also taken from the URL
+	Password    string `json:"password,omitempty"`    // prefer passwordEnv
+	PasswordEnv string `json:"passwordEnv,omitempty"` // environment variable holding the password
+	PrivateKey  string `json:"privateKey,omitempty"`  // SFTP: key file, besides a running ssh-agent
+	KnownHosts  string `json:"knownHosts,omitempty"`  // SFTP: ~/.ssh/known_hosts by default
+	HostKey     string `json:"hostKey,omitempty"`     // SFTP: SHA256 fingerprint of the server key instead of knownHosts
+	DeleteLocal bool   `json:"deleteLocal,omitempty"` // delete the local file once every target has a verified copy
+}
+
+func (c uploadConfig) password() string {
+	if c.PasswordEnv != "" {
+		return os.Getenv(c.PasswordEnv)
+	}
+	return c.Password
+}
+
+// uploadTarget is a server that call files are copied to.
+type uploadTarget interface {
+	// Stat returns an error matching fs.ErrNotExist if there is no such file.
+	Stat(ctx context.Context, name string) (storageObject, error)
+	// WriteFrom writes the size bytes of r into name from offset on. With
+	// offset 0 the file is created or replaced. It returns errResumeUnsupported
+	// if the server cannot continue a file.
+	WriteFrom(ctx context.Context, name string, offset int64, r io.Reader, size int64) error
+	// Rename replaces to with from.
+	Rename(ctx context.Context, from, to string) error
+	Delete(ctx context.Context, name string) error
+	// Location is the address of name, without credentials.
+	Location(name string) string
+	Close() error
+}
+
+// remoteHasher is an uploadTarget that can hash its files itself.
+type remoteHasher interface {
+	SHA256(ctx context.Context, name string) (string, error)
+}
+
+var errResumeUnsupported = errors.New("the server cannot continue an upload")
+
+type upload struct {
+	config uploadConfig
+	target uploadTarget
+}
+
+// newUploads connects the targets of the "uploads" list lazily; nothing is sent
+// before the first upload.
+func newUploads(configs []uploadConfig, client *http.Client) ([]*upload, error) {
+	var uploads []*upload
+	names := make(map[string]bool)
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("upload %d has no name", i+1)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("upload name %q is used twice", cfg.Name)
+		}
+		names[cfg.Name] = true
+		u, err := url.Parse(cfg.URL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("upload %q: invalid url %q", cfg.Name, cfg.URL)
+		}
+		var target uploadTarget
+		switch u.Scheme {
+		case "http", "https":
+			target = newWebDAVTarget(u, cfg, client)
+		case "sftp":
+			target, err = newSFTPTarget(u, cfg)
+		default:
+			err = fmt.Errorf("unsupported scheme %q, expected https or sftp", u.Scheme)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("upload %q: %w", cfg.Name, err)
+		}
+		uploads = append(uploads, &upload{config: cfg, target: target})
+	}
+	return uploads, nil
+}
+
+// uploadQueue runs the uploads of downloaded calls one at a time and apart from
+// the downloads, so an upload holds no download slot or disk reservation.
+type uploadQueue struct {
+	ctx context.Context
+	mu  sync.Mutex // held by the running upload
+	wg  sync.WaitGroup
+}
+
+// startUploads makes queued uploads run until ctx is done.
+func (d *downloader) startUploads(ctx context.Context) {
+	d.upQueue = &uploadQueue{ctx: ctx}
+}
+
+// queueUpload uploads a call in the background once the uploads queued before
+// it are done. Nothing is uploaded before startUploads.
+func (d *downloader) queueUpload(liveId int) {
+	q := d.upQueue
+	if q == nil || len(d.uploads) == 0 {
+		return
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		d.uploadCall(q.ctx, liveId)
+	}()
+}
+
+// waitUploads waits for the queued uploads.
+func (d *downloader) waitUploads() {
+	if d.upQueue != nil {
+		d.upQueue.wg.Wait()
+	}
+}
+
+func closeUploads(uploads []*upload) {
+	for _, u := range uploads {
+		u.target.Close()
+	}
+}
+
+// uploadable reports whether a call has a local file whose recorded hashes
+// match its manifest entry. Calls without an entry, or downloaded with -f, are
+// not uploaded, as a copy could not be told apart from a corrupt file.
+func (d *downloader) uploadable(liveIdStr string) bool {
+	entry, ok := d.manifest.Calls[liveIdStr]
+	if !ok || !d.library.has(liveIdStr) || d.library.deleted(liveIdStr) {
+		return false
+	}
+	hashes := d.library.recorded(liveIdStr)
+	return hashes != nil && entry.verify(-1, hashes) == nil
+}
+
+// uploadCall copies the file of a verified call to every target that does not
+// have a verified copy yet, and deletes it locally afterwards if a target asks
+// for it. Failed uploads are logged and tried again in the next run.
+func (d *downloader) uploadCall(ctx context.Context, liveId int) {
+	if len(d.uploads) == 0 {
+		return
+	}
+	liveIdStr := strconv.Itoa(liveId)
+	if !d.uploadable(liveIdStr) {
+		return
+	}
+	path := filepath.Join(d.config.OutputDir, liveIdStr+".mp4")
+	complete, deleteLocal := true, false
+	for _, u := range d.uploads {
+		if _, ok := d.library.copyOn(liveIdStr, u.config.Name); ok {
+			deleteLocal = deleteLocal || u.config.DeleteLocal
+			continue
+		}
+		c, err := d.uploadCopy(ctx, u, liveIdStr, path)
+		if err != nil {
+			complete = false
+			slog.Warn("Upload failed, trying again in the next run", "liveId", liveId, "target", u.config.Name, "err", err)
+			continue
+		}
+		d.library.addCopy(liveIdStr, c)
+		deleteLocal = deleteLocal || u.config.DeleteLocal
+		slog.Info("Uploaded copy", "liveId", liveId, "target", u.config.Name, "location", c.Location, "verified", c.Verified)
+	}
+	if complete && deleteLocal {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("Could not delete uploaded file", "liveId", liveId, "err", err)
+		} else {
+			d.library.markDeleted(liveIdStr)
+			slog.Info("Deleted local file, it has been uploaded", "liveId", liveId)
+		}
+	}
+	if err := d.library.save(); err != nil {
+		slog.Warn("Could not save library index", "err", err)
+	}
+}
+
+// uploadPending uploads the verified calls that have a local file but are
+// missing from a target, e.g. because an earlier upload failed or the target is new.
+func (d *downloader) uploadPending(ctx context.Context, liveIds []int) {
+	for _, liveId := range liveIds {
+		if ctx.Err() != nil {
+			return
+		}
+		liveIdStr := strconv.Itoa(liveId)
+		if !d.uploadable(liveIdStr) {
+			continue
+		}
+		for _, u := range d.uploads {
+			if _, ok := d.library.copyOn(liveIdStr, u.config.Name); !ok {
+				d.uploadCall(ctx, liveId)
+				break
+			}
+		}
+	}
+}
+
+// uploadCopy uploads a file to a target as <name>.part, continuing a previous
+// attempt when the server allows it, and moves it into place once it is whole.
+func (d *downloader) uploadCopy(ctx context.Context, u *upload, liveIdStr, path string) (remoteCopy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return remoteCopy{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return remoteCopy{}, err
+	}
+	size := info.Size()
+	name := liveIdStr + ".mp4"
+	partName := name + ".part"
+
+	if existing, err := u.target.Stat(ctx, name); err == nil && existing.Size == size {
+		// uploaded before the index knew about it, or by someone else
+		slog.Debug("Copy already on target", "liveId", liveIdStr, "target", u.config.Name)
+	} else {
+		var offset int64
+		if part, err := u.target.Stat(ctx, partName); err == nil && part.Size <= size {
+			offset = part.Size
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return remoteCopy{}, err
+		}
+		if offset > 0 {
+			slog.Debug("Resuming upload", "liveId", liveIdStr, "target", u.config.Name, "offset", offset)
+		}
+		// send writes the file from offset on and returns how large the part is afterwards
+		send := func(offset int64) (int64, error) {
+			if err := u.target.WriteFrom(ctx, partName, offset, io.NewSectionReader(file, offset, size-offset), size-offset); err != nil {
+				return 0, err
+			}
+			part, err := u.target.Stat(ctx, partName)
+			return part.Size, err
+		}
+		uploaded, err := send(offset)
+		if offset > 0 && (errors.Is(err, errResumeUnsupported) || err == nil && uploaded != size) {
+			// e.g. a server that replaced the part with the range instead of continuing it
+			slog.Debug("Could not resume upload, starting over", "liveId", liveIdStr, "target", u.config.Name, "err", err)
+			uploaded, err = send(0)
+		}
+		if err != nil {
+			return remoteCopy{}, err
+		}
+		if uploaded != size {
+			u.target.Delete(ctx, partName)
+			return remoteCopy{}, fmt.Errorf("uploaded %d bytes, expected %d", uploaded, size)
+		}
+		if err := u.target.Rename(ctx, partName, name); err != nil {
+			return remoteCopy{}, err
+		}
+	}
+	return d.verifyCopy(ctx, u, liveIdStr, path, name, size)
+}
+
+// verifyCopy checks the size of an uploaded file and, if the server can hash
+// it, its SHA-256.
+func (d *downloader) verifyCopy(ctx context.Context, u *upload, liveIdStr, path, name string, size int64) (remoteCopy, error) {
+	remote, err := u.target.Stat(ctx, name)
+	if err != nil {
+		return remoteCopy{}, err
+	}
+	if remote.Size != size {
+		return remoteCopy{}, fmt.Errorf("remote copy has %d bytes, expected %d", remote.Size, size)
+	}
+	c := remoteCopy{Target: u.config.Name, Location: u.target.Location(name), Size: size, Verified: "size", Uploaded: time.Now()}
+	hasher, ok := u.target.(remoteHasher)
+	if !ok {
+		return c, nil
+	}
+	remoteSum, err := hasher.SHA256(ctx, name)
+	if err != nil {
+		slog.Debug("Could not hash remote copy, checked its size only", "liveId", liveIdStr, "target", u.config.Name, "err", err)
+		return c, nil
+	}
+	localSum := d.library.recorded(liveIdStr)["sha256"]
+	if localSum == "" {
+		sums, err := checksum(path, "sha256")
+		if err != nil {
+			return remoteCopy{}, err
+		}
+		localSum = sums["sha256"]
+	}
+	if remoteSum != localSum {
+		return remoteCopy{}, fmt.Errorf("remote copy has SHA-256 %s, expected %s", remoteSum, localSum)
+	}
+	c.Verified = "sha256"
+	return c, nil
+}
@@ -4,7 +4,9 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -54,9 +56,66 @@ func hookTotalProgress(bar, totalBar *mpb.Bar) {
                 totalBar.IncrBy(int(delta))
                 lastVal = curr
             }
-            if bar.Completed() {
+            if bar.Completed() || bar.Aborted() {
                 break
             }
         }
     }()
 }
+
+// parseByteSize parses sizes such as "512K", "20M" or "5G" (binary units).
+// A plain number is taken as bytes.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	multiplier := int64(1)
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	if unit == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	switch unit[len(unit)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	case 'T':
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		unit = unit[:len(unit)-1]
+	}
+	value, err := strconv.ParseFloat(unit, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// formatByteSize is the inverse of parseByteSize, used for messages.
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.2f KiB", float64(n)/(1<<10))
+	}
+}
+
+// parseCallFileName returns the live ID of a downloaded call file named "<liveId>.mp4".
+func parseCallFileName(name string) (int, bool) {
+	liveIdStr, ok := strings.CutSuffix(name, ".mp4")
+	if !ok {
+		return 0, false
+	}
+	liveId, err := strconv.Atoi(liveIdStr)
+	if err != nil || liveId < 0 {
+		return 0, false
+	}
+	return liveId, true
+}
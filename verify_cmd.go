@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fatih/color"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// verifyCommand checks the call files of the output directory against the manifest.
+// Results are cached in the library index, so files that have not changed since
+// the last run are not hashed again. Files are only touched with -fix.
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	outputDir := flags.String("o", "Downloads", "Directory with downloaded videos")
+	concurrency := flags.Int("c", 4, "Files hashed in parallel")
+	full := flags.Bool("full", false, "Hash every file again instead of trusting cached results")
+	fix := flags.Bool("fix", false, "Move mismatching files to the "+quarantineDirName+" folder")
+	manifestSource := flags.String("manifest", "", "Hash file path or HTTPS URL (default is the hash file built into the binary)")
+	manifestKey := flags.String("manifest-key", manifestPublicKey, "Base64 ed25519 public key for remote hash files")
+	transport := addTransportFlags(flags)
+	logging := addLogFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: phoning-downloader verify [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	closeLog, err := setupLogging(logging())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	if *concurrency < 1 {
+		fatal("Concurrency must be at least 1")
+	}
+	clients, err := newHTTPClients(transport())
+	if err != nil {
+		fatal("Invalid connection settings", "err", err)
+	}
+	m, err := openManifest(context.Background(), clients.API, *manifestSource, *manifestKey)
+	if err != nil {
+		fatal("Error loading hash file", "err", err)
+	}
+	library, err := loadLibraryIndex(*outputDir)
+	if err != nil {
+		fatal("Error loading library index", "err", err)
+	}
+	files, err := os.ReadDir(*outputDir)
+	if err != nil {
+		fatal("Failed to read output directory", "err", err)
+	}
+	var checkIds, extra, partial []int
+	local := make(map[string]bool)
+	for _, file := range files {
+		liveId, ok := parseCallFileName(file.Name())
+		if !ok || file.IsDir() {
+			continue
+		}
+		liveIdStr := strconv.Itoa(liveId)
+		local[liveIdStr] = true
+		if hasCheckpoint(filepath.Join(*outputDir, file.Name())) {
+			partial = append(partial, liveId)
+			continue
+		}
+		if _, ok := m.Calls[liveIdStr]; ok {
+			checkIds = append(checkIds, liveId)
+		} else {
+			extra = append(extra, liveId)
+		}
+	}
+	var missing []string
+	for _, liveIdStr := range m.liveIds() {
+		// calls deleted after they were uploaded are not missing
+		if !local[liveIdStr] && !library.deleted(liveIdStr) {
+			missing = append(missing, liveIdStr)
+		}
+	}
+	slices.Sort(checkIds)
+	slices.Sort(extra)
+	fmt.Printf("Verifying %d files in %s...\n", len(checkIds), *outputDir)
+
+	p := mpb.New(mpb.WithWidth(64))
+	restoreLog := logAbove(p)
+	bar := p.New(int64(len(checkIds)),
+		mpb.BarStyle().Lbound("[").Filler("=").Tip(">").Padding(" ").Rbound("]"),
+		mpb.PrependDecorators(
+			decor.Name("Verifying...", decor.WC{W: 5, C: decor.DindentRight}),
+			decor.Current(0, "(%d", decor.WC{W: 5}),
+			decor.Total(0, "/%d)", decor.WC{W: 5, C: decor.DindentRight}),
+		),
+		mpb.AppendDecorators(
+			decor.NewPercentage("%.2f", decor.WC{W: 7}),
+		),
+	)
+	var cachedCount atomic.Int64
+	verifyFunction := func(liveId int, ctx context.Context) (string, error) {
+		defer bar.IncrInt64(1)
+		liveIdStr := strconv.Itoa(liveId)
+		path := filepath.Join(*outputDir, liveIdStr+".mp4")
+		cached, mismatch, err := library.verifyFile(path, liveIdStr, m.Calls[liveIdStr], *full)
+		if err != nil {
+			return "", fmt.Errorf("live ID %d: %v", liveId, err)
+		}
+		if cached {
+			cachedCount.Add(1)
+		}
+		if mismatch != nil {
+			return mismatch.Error(), nil
+		}
+		return "", nil
+	}
+	results, err := runPool(context.Background(), verifyFunction, checkIds, *concurrency, nil)
+	// completes the bar when there was nothing to verify or hashing stopped early
+	bar.SetTotal(-1, true)
+	p.Wait()
+	restoreLog()
+	if saveErr := library.save(); saveErr != nil {
+		slog.Warn("Could not save library index", "err", saveErr)
+	}
+	if err != nil {
+		fatal("Error verifying files", "err", err)
+	}
+
+	var mismatched []int
+	for _, liveId := range checkIds {
+		if results[liveId] != "" {
+			mismatched = append(mismatched, liveId)
+		}
+	}
+	for _, liveId := range mismatched {
+		fmt.Printf("%s %d: %s\n", color.RedString("mismatch"), liveId, results[liveId])
+		if !*fix {
+			continue
+		}
+		liveIdStr := strconv.Itoa(liveId)
+		record := newQuarantineRecord(liveId, m.Calls[liveIdStr], library.recorded(liveIdStr), errors.New(results[liveId]))
+		dest, err := quarantineFile(*outputDir, record)
+		if err != nil {
+			slog.Error("Could not quarantine file", "liveId", liveId, "err", err)
+			continue
+		}
+		library.forget(liveIdStr)
+		fmt.Printf("  moved to %s\n", dest)
+	}
+	for _, liveId := range extra {
+		fmt.Printf("%s %d: not in the hash file\n", color.YellowString("extra"), liveId)
+	}
+	if len(missing) > 0 {
+		fmt.Printf("%s: %s\n", color.YellowString("missing"), strings.Join(missing, ", "))
+	}
+	for _, liveId := range partial {
+		fmt.Printf("%s %d: interrupted download, resumed by the next run\n", color.YellowString("partial"), liveId)
+	}
+	if *fix && len(mismatched) > 0 {
+		if err := library.save(); err != nil {
+			slog.Warn("Could not save library index", "err", err)
+		}
+	}
+	fmt.Printf("%d ok, %d mismatch, %d missing, %d extra (%d results from cache).\n",
+		len(checkIds)-len(mismatched), len(mismatched), len(missing), len(extra), cachedCount.Load())
+	if len(mismatched) > 0 && !*fix {
+		fmt.Println("Run with -fix to move mismatching files to the " + quarantineDirName + " folder.")
+		os.Exit(1)
+	}
+}
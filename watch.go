@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// watchCommand keeps polling Phoning for calls and downloads the ones that are
+// not in the library index yet, at a fixed interval or as set by the schedule
+// of the config file. Failed cycles are retried with a growing delay, so it can
+// run unattended as a service.
+func watchCommand(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	config := addDownloadFlags(flags)
+	interval := flags.Duration("interval", 15*time.Minute, "Time between checks for new calls, unless the config file has a schedule")
+	jitter := flags.Float64("jitter", 0.1, "Random fraction by which each interval is lengthened or shortened")
+	maxBackoff := flags.Duration("max-backoff", time.Hour, "Longest wait after failed checks")
+	progress := flags.Bool("progress", false, "Draw progress bars instead of only logging")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: phoning-downloader watch [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	cfg := config()
+	closeLog, err := setupLogging(cfg.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	if err := cfg.validate(); err != nil {
+		fatal(err.Error())
+	}
+	if *interval <= 0 || *jitter < 0 || *jitter >= 1 {
+		fatal("-interval must be positive and -jitter between 0 and 1")
+	}
+	limiter, err := cfg.rateLimiter()
+	if err != nil {
+		fatal(err.Error())
+	}
+	disk, err := cfg.diskLedger()
+	if err != nil {
+		fatal(err.Error())
+	}
+	fileCfg, err := loadConfig(cfg.ConfigFile)
+	if err != nil {
+		fatal("Error loading config", "err", err)
+	}
+	sched := &schedule{every: *interval}
+	if fileCfg.Schedule != nil {
+		if sched, err = newSchedule(*fileCfg.Schedule); err != nil {
+			fatal("Invalid schedule", "err", err)
+		}
+		if !sched.triggered() {
+			sched.every = *interval
+		}
+	}
+	sched.jitter = *jitter
+	clients, err := newHTTPClients(cfg.Transport)
+	if err != nil {
+		fatal("Invalid connection settings", "err", err)
+	}
+	s, err := newSession(clients)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		fatal("Failed to create Downloads directory", "err", err)
+	}
+	library, err := loadLibraryIndex(cfg.OutputDir)
+	if err != nil {
+		fatal("Error loading library index", "err", err)
+	}
+	hooks, err := newHooks(fileCfg.Hooks, clients.API)
+	if err != nil {
+		fatal("Invalid hook", "err", err)
+	}
+	uploads, err := newUploads(fileCfg.Uploads, clients.Download)
+	if err != nil {
+		fatal("Invalid upload", "err", err)
+	}
+	defer closeUploads(uploads)
+	d := &downloader{config: cfg, session: s, library: library, manifest: newManifest(), limiter: limiter, disk: disk, hooks: hooks, store: &localStorage{dir: cfg.OutputDir}, uploads: uploads, quiet: !*progress}
+	stats.watchDisk(cfg.OutputDir)
+	if cfg.Metrics != "" {
+		server, err := serveMetrics(cfg.Metrics)
+		if err != nil {
+			fatal(err.Error())
+		}
+		defer server.Close()
+		slog.Info("Serving metrics", "url", "http://"+cfg.Metrics+"/metrics")
+	}
+	if cfg.LimitControl != "" {
+		server, err := serveRateControl(cfg.LimitControl, limiter)
+		if err != nil {
+			fatal(err.Error())
+		}
+		defer server.Close()
+		slog.Info("Bandwidth limit can be changed", "url", "http://"+cfg.LimitControl+"/limit")
+	}
+	if cfg.Adaptive {
+		d.controller = newAdaptiveController(cfg.Concurrency, cfg.Chunks)
+		go d.controller.Run(context.Background())
+	}
+
+	failures := 0
+	next := sched.next(time.Time{}, time.Now())
+	for cycle := 1; ; cycle++ {
+		if wait := time.Until(next); wait > 0 {
+			slog.Info("Waiting for the next check", "at", next.Format(time.DateTime))
+			time.Sleep(wait)
+		}
+		started := time.Now()
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if deadline := sched.deadline(started); !deadline.IsZero() {
+			// maximum runtime or quiet hours, interrupted downloads resume in the next cycle
+			ctx, cancel = context.WithDeadlineCause(ctx, deadline, errPaused)
+		}
+		listed, downloaded, err := d.watchCycle(ctx)
+		cancel()
+		elapsed := time.Since(started).Round(time.Second)
+		next = sched.next(started, time.Now())
+		if err != nil && !errors.Is(err, errPaused) {
+			hooks.fire(hookEvent{Event: eventRunFailed, Error: err.Error()})
+		} else {
+			hooks.fire(hookEvent{Event: eventRunSummary, Listed: listed, Downloaded: downloaded, Duration: elapsed.String(), Paused: err != nil})
+		}
+		switch {
+		case errors.Is(err, errPaused):
+			failures = 0
+			slog.Info("Cycle paused", "cycle", cycle, "elapsed", elapsed, "listed", listed, "downloaded", downloaded)
+		case err != nil:
+			failures++
+			slog.Error("Cycle failed", "cycle", cycle, "elapsed", elapsed, "failures", failures, "err", err)
+			retry := time.Now().Add(watchBackoff(*maxBackoff, failures))
+			if until, quiet := sched.quietUntil(retry); quiet {
+				retry = until
+			}
+			if retry.Before(next) {
+				next = retry
+			}
+		default:
+			failures = 0
+			slog.Info("Cycle finished", "cycle", cycle, "elapsed", elapsed, "listed", listed, "downloaded", downloaded)
+		}
+	}
+}
+
+// watchCycle lists the calls once and downloads those the library index does
+// not know about.
+func (d *downloader) watchCycle(ctx context.Context) (listed, downloaded int, err error) {
+	d.startUploads(ctx)
+	defer d.waitUploads()
+	liveIds, _, err := d.session.fetchCalls()
+	if err != nil {
+		return 0, 0, fmt.Errorf("listing calls: %w", err)
+	}
+	d.discover(liveIds)
+	if !d.config.DisableHash {
+		// reloaded every cycle so manifest updates are picked up; remote ones are revalidated by ETag
+		m, err := openManifest(context.Background(), d.session.clients.API, d.config.ManifestSource, d.config.ManifestKey)
+		switch {
+		case err == nil:
+			d.manifest = m
+		case len(d.manifest.Calls) == 0:
+			return len(liveIds), 0, fmt.Errorf("loading hash file: %w", err)
+		default:
+			slog.Warn("Could not reload hash file, using the previous one", "err", err)
+		}
+	}
+
+	var newIds []int
+	adopted := 0
+	for _, liveId := range liveIds {
+		liveIdStr := strconv.Itoa(liveId)
+		if d.library.has(liveIdStr) {
+			continue
+		}
+		entry, inManifest := d.manifest.Calls[liveIdStr]
+		if !inManifest && d.config.Unverified == "skip" && !d.config.DisableHash {
+			continue
+		}
+		// a file from before the index existed counts once it verifies
+		path := filepath.Join(d.config.OutputDir, liveIdStr+".mp4")
+		if _, statErr := os.Stat(path); statErr == nil && !hasCheckpoint(path) {
+			if !inManifest || d.config.DisableHash {
+				// nothing to verify against, keep the file as it is like a normal run does
+				continue
+			}
+			_, mismatch, err := d.library.verifyFile(path, liveIdStr, entry, false)
+			if err != nil {
+				slog.Warn("Could not check existing file, trying again in the next cycle", "liveId", liveId, "err", err)
+				continue
+			}
+			if mismatch == nil {
+				adopted++
+				continue
+			}
+			// keep the file around in case the manifest is the one that is wrong
+			dest, err := quarantineFile(d.config.OutputDir, newQuarantineRecord(liveId, entry, d.library.recorded(liveIdStr), mismatch))
+			if err != nil {
+				// not in the index, so the next cycle checks the file again
+				d.library.forget(liveIdStr)
+				if err := d.library.save(); err != nil {
+					slog.Warn("Could not save library index", "err", err)
+				}
+				slog.Warn("Could not quarantine existing file, trying again in the next cycle", "liveId", liveId, "err", err)
+				continue
+			}
+			d.library.forget(liveIdStr)
+			slog.Warn("Quarantined file with hash mismatch", "liveId", liveId, "dest", dest)
+			d.hooks.fire(hookEvent{Event: eventHashMismatch, LiveId: liveId, File: path, Error: mismatch.Error()})
+		}
+		newIds = append(newIds, liveId)
+	}
+	if adopted > 0 {
+		slog.Info("Added verified existing files to the library index", "count", adopted)
+		if err := d.library.save(); err != nil {
+			slog.Warn("Could not save library index", "err", err)
+		}
+	}
+	if len(newIds) == 0 {
+		d.uploadPending(ctx, liveIds)
+		return len(liveIds), 0, nil
+	}
+	slog.Info("Found new calls", "count", len(newIds))
+	sizes, err := d.fetchSizes(newIds)
+	if err != nil {
+		return len(liveIds), 0, fmt.Errorf("fetching sizes: %w", err)
+	}
+	downloaded, err = d.downloadCalls(ctx, newIds, sizes)
+	if err != nil {
+		return len(liveIds), downloaded, err
+	}
+	d.waitUploads()
+	d.uploadPending(ctx, liveIds)
+	return len(liveIds), downloaded, nil
+}
+
+// discover fires call.discovered for calls that were not listed by the previous
+// cycle. The first cycle only notes what is listed.
+func (d *downloader) discover(liveIds []int) {
+	listed := make(map[int]bool, len(liveIds))
+	for _, liveId := range liveIds {
+		listed[liveId] = true
+		if d.listed != nil && !d.listed[liveId] {
+			d.hooks.fire(hookEvent{Event: eventCallDiscovered, LiveId: liveId})
+		}
+	}
+	d.listed = listed
+}
+
+// watchBackoff is the delay before retrying after consecutive failures: a
+// minute, doubled for every further failure, up to limit.
+func watchBackoff(limit time.Duration, failures int) time.Duration {
+	wait := time.Minute
+	for i := 1; i < failures && wait < limit; i++ {
+		wait *= 2
+	}
+	return min(wait, limit)
+}
+
+// jittered lengthens or shortens d by a random fraction of up to jitter, so that
+// several instances do not poll in lockstep.
+func jittered(d time.Duration, jitter float64) time.Duration {
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+// webdavTarget uploads to a collection of a WebDAV server. Uploads are resumed
+// with a PUT of the missing range, which e.g. Apache's mod_dav accepts.
+type webdavTarget struct {
+	base     *url.URL // the collection, ending in a slash and without credentials
+	username string
+	password string
+	client   *http.Client
+
+	mu      sync.Mutex
+	created bool // whether the collection is known to exist
+}
+
+func newWebDAVTarget(u *url.URL, cfg uploadConfig, client *http.Client) *webdavTarget {
+	base := *u
+	base.User = nil
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	t := &webdavTarget{base: &base, username: cfg.Username, password: cfg.password(), client: client}
+	if u.User != nil && t.username == "" {
+		t.username = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+	return t
+}
+
+func (t *webdavTarget) Location(name string) string {
+	if name == "" {
+		return t.base.String()
+	}
+	return t.base.JoinPath(name).String()
+}
+
+func (t *webdavTarget) Close() error {
+	return nil
+}
+
+// do sends a request without a body that can be repeated, retrying server and
+// network errors. The status has to be one of ok.
+func (t *webdavTarget) do(ctx context.Context, method, name string, header map[string]string, body string, ok ...int) (*http.Response, []byte, error) {
+	var lastErr error
+	for attempt := range maxRetries {
+		if attempt > 0 {
+			if err := sleepContext(ctx, retryDelay(attempt-1, lastErr)); err != nil {
+				return nil, nil, err
+			}
+		}
+		req, err := t.request(ctx, method, name, strings.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			lastErr = err
+		} else {
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case err != nil:
+				lastErr = err
+			case slices.Contains(ok, resp.StatusCode):
+				return resp, data, nil
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				lastErr = newStatusError(resp)
+			default:
+				return resp, nil, fmt.Errorf("%s %s: %w", method, name, newStatusError(resp))
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if attempt < maxRetries-1 {
+			slog.Warn("Retrying WebDAV request", "method", method, "name", name, "attempt", attempt+1, "err", lastErr)
+		}
+	}
+	return nil, nil, fmt.Errorf("%s %s: %w", method, name, lastErr)
+}
+
+func (t *webdavTarget) request(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.Location(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	return req, nil
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status        string `xml:"DAV: status"`
+			ContentLength string `xml:"DAV: prop>getcontentlength"`
+			LastModified  string `xml:"DAV: prop>getlastmodified"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func (t *webdavTarget) Stat(ctx context.Context, name string) (storageObject, error) {
+	resp, data, err := t.do(ctx, "PROPFIND", name, map[string]string{"Depth": "0", "Content-Type": "application/xml"}, webdavPropfind, http.StatusMultiStatus, http.StatusNotFound)
+	if err != nil {
+		return storageObject{}, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return storageObject{}, fmt.Errorf("%s: %w", t.Location(name), fs.ErrNotExist)
+	}
+	var ms webdavMultistatus
+	if err := xml.Unmarshal(data, &ms); err != nil {
+		return storageObject{}, fmt.Errorf("PROPFIND %s: %v", name, err)
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200") || ps.ContentLength == "" {
+				continue
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(ps.ContentLength), 10, 64)
+			if err != nil {
+				return storageObject{}, fmt.Errorf("PROPFIND %s: invalid size %q", name, ps.ContentLength)
+			}
+			modified, _ := http.ParseTime(ps.LastModified)
+			return storageObject{Name: name, Size: size, Modified: modified}, nil
+		}
+	}
+	return storageObject{}, fmt.Errorf("PROPFIND %s: no size in the response", name)
+}
+
+// ensureCollection creates the collection uploads go to, unless it exists.
+func (t *webdavTarget) ensureCollection(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.created {
+		return nil
+	}
+	// 405 is the answer for a collection that exists already
+	if _, _, err := t.do(ctx, "MKCOL", "", nil, "", http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+		return err
+	}
+	t.created = true
+	return nil
+}
+
+func (t *webdavTarget) WriteFrom(ctx context.Context, name string, offset int64, r io.Reader, size int64) error {
+	if err := t.ensureCollection(ctx); err != nil {
+		return err
+	}
+	req, err := t.request(ctx, http.MethodPut, name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if offset > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+size-1))
+	}
+	start := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		slog.Debug("Uploaded to WebDAV", "name", name, "offset", offset, "size", size, "elapsed", time.Since(start))
+		return nil
+	case offset > 0 && slices.Contains([]int{http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusRequestedRangeNotSatisfiable, http.StatusNotImplemented}, resp.StatusCode):
+		return fmt.Errorf("PUT %s: %w", name, errors.Join(errResumeUnsupported, newStatusError(resp)))
+	default:
+		return fmt.Errorf("PUT %s: %w", name, newStatusError(resp))
+	}
+}
+
+func (t *webdavTarget) Rename(ctx context.Context, from, to string) error {
+	header := map[string]string{"Destination": t.Location(to), "Overwrite": "T"}
+	_, _, err := t.do(ctx, "MOVE", from, header, "", http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+func (t *webdavTarget) Delete(ctx context.Context, name string) error {
+	resp, _, err := t.do(ctx, http.MethodDelete, name, nil, "", http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", t.Location(name), fs.ErrNotExist)
+	}
+	return nil
+}